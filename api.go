@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const apiPrefix = "/api/v1/"
+
+// DownlinkRequest type
+// body of POST /api/v1/devices/{deveui}/downlinks
+type DownlinkRequest struct {
+	FPort     uint8                  `json:"fport"`
+	Payload   string                 `json:"payload"`
+	Encoding  string                 `json:"encoding"` // hex (default) or base64
+	Confirmed bool                   `json:"confirmed"`
+	Command   map[string]interface{} `json:"command"` // instead of fport and payload, for devices with encoder
+}
+
+// JobRequest type
+// body of POST /api/v1/devices/{deveui}/jobs
+type JobRequest struct {
+	DownlinkRequest
+	At       *time.Time `json:"at"`        // RFC3339, now if missing
+	OnUplink bool       `json:"on_uplink"` // wait for the next uplink from device
+	Policy   string     `json:"policy"`    // replace or append, configured policy if missing
+}
+
+// GroupJobRequest type
+// body of POST /api/v1/groups
+type GroupJobRequest struct {
+	JobRequest
+	Target GroupTarget `json:"target"`
+}
+
+// apiError type
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// ServeAPI func
+// REST API lives on the same listener as /metrics, nothing is exposed without api keys configured
+func (ctx *Context) ServeAPI() {
+	if len(ctx.API.Keys) == 0 {
+		logger.Infoln("No api keys configured, REST API disabled")
+		return
+	}
+	http.Handle(apiPrefix, ctx.apiAuth(http.HandlerFunc(ctx.apiRouter)))
+	logger.Infof("REST API enabled on %s", apiPrefix)
+}
+
+// apiAuth func
+// key goes either in X-API-Key header or as bearer token
+func (ctx *Context) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		for _, allowed := range ctx.API.Keys {
+			if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(allowed)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		apiRequests.WithLabelValues("unauthorized").Inc()
+		writeJSON(w, http.StatusUnauthorized, apiError{"invalid or missing api key"})
+	})
+}
+
+func (ctx *Context) apiRouter(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+
+	switch {
+	case len(parts) == 3 && parts[0] == "devices" && parts[2] == "downlinks":
+		deveui := strings.ToUpper(parts[1])
+		switch r.Method {
+		case http.MethodPost:
+			ctx.apiPostDownlink(w, r, deveui)
+		case http.MethodGet:
+			ctx.apiGetDownlinks(w, r, deveui)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+		}
+	case len(parts) == 3 && parts[0] == "devices" && parts[2] == "jobs":
+		deveui := strings.ToUpper(parts[1])
+		switch r.Method {
+		case http.MethodPost:
+			ctx.apiPostJob(w, r, deveui)
+		case http.MethodGet:
+			apiRequests.WithLabelValues("list").Inc()
+			writeJSON(w, http.StatusOK, struct {
+				Jobs []DownlinkJob `json:"jobs"`
+			}{ctx.scheduler.List(deveui)})
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+		}
+	case len(parts) == 1 && parts[0] == "jobs":
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		apiRequests.WithLabelValues("list").Inc()
+		writeJSON(w, http.StatusOK, struct {
+			Jobs []DownlinkJob `json:"jobs"`
+		}{ctx.scheduler.List("")})
+	case len(parts) == 2 && parts[0] == "jobs":
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{"job id must be integer"})
+			return
+		}
+		var (
+			job DownlinkJob
+			ok  bool
+		)
+		switch r.Method {
+		case http.MethodGet:
+			job, ok = ctx.scheduler.Get(id)
+		case http.MethodDelete:
+			job, ok = ctx.scheduler.Cancel(id)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusNotFound, apiError{"job not found"})
+			return
+		}
+		apiRequests.WithLabelValues("job").Inc()
+		writeJSON(w, http.StatusOK, job)
+	case len(parts) == 1 && parts[0] == "groups":
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		ctx.apiPostGroup(w, r)
+	case len(parts) == 2 && parts[0] == "groups":
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{"group id must be integer"})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			for _, job := range ctx.scheduler.List("") {
+				if job.Group == id {
+					ctx.scheduler.Cancel(job.ID)
+				}
+			}
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		status, ok := ctx.scheduler.Group(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, apiError{"group not found"})
+			return
+		}
+		apiRequests.WithLabelValues("group").Inc()
+		writeJSON(w, http.StatusOK, status)
+	case len(parts) == 2 && parts[0] == "downlinks":
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		ctx.apiGetDownlink(w, r, parts[1])
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+	}
+}
+
+func (ctx *Context) apiPostDownlink(w http.ResponseWriter, r *http.Request, deveui string) {
+	var req DownlinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{"can't parse request: " + err.Error()})
+		return
+	}
+
+	msg, err := req.Downlink(deveui)
+	if err != nil {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	err = ctx.SubmitDownlink(&msg)
+	if derr, invalid := err.(*DownlinkError); invalid {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, struct {
+			Error *DownlinkError `json:"error"`
+		}{derr})
+		return
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"DevEui": deveui, "MsgId": msg.MsgID}).Errorf("API downlink not sent %+v", err)
+		apiRequests.WithLabelValues("not_sent").Inc()
+		writeJSON(w, http.StatusServiceUnavailable, struct {
+			MsgID int64  `json:"MsgId"`
+			Error string `json:"error"`
+		}{msg.MsgID, err.Error()})
+		return
+	}
+
+	apiRequests.WithLabelValues("accepted").Inc()
+	writeJSON(w, http.StatusAccepted, struct {
+		MsgID int64 `json:"MsgId"`
+	}{msg.MsgID})
+}
+
+func (ctx *Context) apiPostJob(w http.ResponseWriter, r *http.Request, deveui string) {
+	var req JobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{"can't parse request: " + err.Error()})
+		return
+	}
+	if req.Policy != "" && req.Policy != pendingReplace && req.Policy != pendingAppend {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{"unknown policy " + req.Policy})
+		return
+	}
+
+	msg, err := req.Downlink(deveui)
+	if err != nil {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	// commands are encoded when the job goes, plain downlinks can be checked right away
+	if msg.Command == nil {
+		if derr := ValidateDownlink(&msg); derr != nil {
+			apiRequests.WithLabelValues("bad_request").Inc()
+			writeJSON(w, http.StatusBadRequest, struct {
+				Error *DownlinkError `json:"error"`
+			}{derr})
+			return
+		}
+	}
+
+	job := ctx.scheduler.Add(DownlinkJob{DevEui: deveui, Downlink: msg, At: req.At, OnUplink: req.OnUplink}, req.Policy)
+	apiRequests.WithLabelValues("scheduled").Inc()
+	writeJSON(w, http.StatusCreated, job)
+}
+
+func (ctx *Context) apiPostGroup(w http.ResponseWriter, r *http.Request) {
+	var req GroupJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{"can't parse request: " + err.Error()})
+		return
+	}
+	if req.Policy != "" && req.Policy != pendingReplace && req.Policy != pendingAppend {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{"unknown policy " + req.Policy})
+		return
+	}
+	devices, err := ctx.ExpandGroup(req.Target)
+	if err == nil && len(devices) == 0 {
+		err = fmt.Errorf("no devices match the group target")
+	}
+	if err != nil {
+		apiRequests.WithLabelValues("bad_request").Inc()
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	var jobs []DownlinkJob
+	for _, deveui := range devices {
+		msg, err := req.Downlink(deveui)
+		if err != nil {
+			apiRequests.WithLabelValues("bad_request").Inc()
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		job := DownlinkJob{DevEui: deveui, Downlink: msg, At: req.At, OnUplink: req.OnUplink}
+		// devices the downlink doesn't fit are failed in the group, the rest still goes
+		if msg.Command == nil {
+			if derr := ValidateDownlink(&msg); derr != nil {
+				job.Error = derr.Error()
+			}
+		}
+		jobs = append(jobs, job)
+	}
+
+	status, _ := ctx.scheduler.Group(ctx.scheduler.AddGroup(jobs, req.Policy))
+	apiRequests.WithLabelValues("scheduled").Inc()
+	writeJSON(w, http.StatusCreated, status)
+}
+
+func (ctx *Context) apiGetDownlinks(w http.ResponseWriter, r *http.Request, deveui string) {
+	apiRequests.WithLabelValues("list").Inc()
+	writeJSON(w, http.StatusOK, struct {
+		Downlinks []DownlinkEntry `json:"downlinks"`
+	}{ledger.Device(deveui)})
+}
+
+func (ctx *Context) apiGetDownlink(w http.ResponseWriter, r *http.Request, id string) {
+	msgID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"MsgId must be integer"})
+		return
+	}
+	entry, ok := ledger.Get(msgID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{"downlink not found"})
+		return
+	}
+	apiRequests.WithLabelValues("get").Inc()
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// Downlink func
+// converts api request into the dndf we are sending to TCIO
+func (req *DownlinkRequest) Downlink(deveui string) (TracknetDnDfSpecialMsg, error) {
+	var (
+		payload []byte
+		err     error
+	)
+
+	if req.Command != nil {
+		if req.Payload != "" || req.FPort != 0 {
+			return TracknetDnDfSpecialMsg{}, fmt.Errorf("command goes instead of fport and payload, not along with them")
+		}
+		return TracknetDnDfSpecialMsg{
+			MsgType: "dndf",
+			DevEui:  deveui,
+			Confirm: req.Confirmed,
+			Command: req.Command,
+		}, nil
+	}
+
+	switch req.Encoding {
+	case "", "hex":
+		payload, err = hex.DecodeString(req.Payload)
+	case "base64":
+		payload, err = base64.StdEncoding.DecodeString(req.Payload)
+	default:
+		return TracknetDnDfSpecialMsg{}, fmt.Errorf("unknown payload encoding %s", req.Encoding)
+	}
+	if err != nil {
+		return TracknetDnDfSpecialMsg{}, fmt.Errorf("can't decode %s payload: %v", req.Encoding, err)
+	}
+	return TracknetDnDfSpecialMsg{
+		MsgType:    "dndf",
+		FPort:      req.FPort,
+		FRMPayload: strings.ToUpper(hex.EncodeToString(payload)),
+		DevEui:     deveui,
+		Confirm:    req.Confirmed,
+	}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("Can't write api response %+v", err)
+	}
+}
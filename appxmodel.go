@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math"
+	"strconv"
 	"sync"
 	"time"
 
@@ -81,12 +84,13 @@ type TracknetDnDfMsg struct {
 
 // TracknetDnDfSpecialMsg type
 type TracknetDnDfSpecialMsg struct {
-	MsgType    string `json:"msgtype,omitempty"`
-	MsgID      int64  `json:"MsgId,omitempty"`
-	FPort      uint8  `json:"FPort,omitempty"`
-	FRMPayload string `json:"FRMPayload,omitempty"`
-	DevEui     string `json:"DevEui,omitempty"`
-	Confirm    bool   `json:"confirm,omitempty"`
+	MsgType    string                 `json:"msgtype,omitempty"`
+	MsgID      int64                  `json:"MsgId,omitempty"`
+	FPort      uint8                  `json:"FPort,omitempty"`
+	FRMPayload string                 `json:"FRMPayload,omitempty"`
+	DevEui     string                 `json:"DevEui,omitempty"`
+	Confirm    bool                   `json:"confirm,omitempty"`
+	Command    map[string]interface{} `json:"command,omitempty"` // not for TCIO, turned into FPort/FRMPayload by device encoder
 }
 
 /*
@@ -393,6 +397,57 @@ func (m *TrackNetMessage) GetFRMPayload() string {
 	return ""
 }
 
+// GetFPort func
+func (m *TrackNetMessage) GetFPort() uint8 {
+	switch m.MsgType {
+	case "updf":
+		return m.TracknetUpDfMsg.FPort
+	case "upinfo":
+		return m.TracknetUpInfoMsg.FPort
+	case "dndf":
+		return m.TracknetDnDfMsg.FPort
+	}
+	return 0
+}
+
+// GetID func
+// stable identity of the event, so replays and retries overwrite stored copy instead of duplicating it
+func (m *TrackNetMessage) GetID(raw []byte) string {
+	switch m.MsgType {
+	case "updf":
+		if m.TracknetUpDfMsg.UPID != "" {
+			return string(m.TracknetUpDfMsg.UPID)
+		}
+	case "upinfo":
+		if m.TracknetUpInfoMsg.UPID != "" {
+			return string(m.TracknetUpInfoMsg.UPID)
+		}
+	case "dndf":
+		if m.TracknetDnDfMsg.MsgID != "" && m.TracknetDnDfMsg.MsgID != "0" {
+			return string(m.TracknetDnDfMsg.MsgID) + "-" + m.MsgType
+		}
+	case "dntxed":
+		if m.TracknetDnTxedMsg.MsgID != "" && m.TracknetDnTxedMsg.MsgID != "0" {
+			return string(m.TracknetDnTxedMsg.MsgID) + "-" + m.MsgType
+		}
+	case "dnacked":
+		if m.TracknetDnAckedMsg.MsgID != "" && m.TracknetDnAckedMsg.MsgID != "0" {
+			return string(m.TracknetDnAckedMsg.MsgID) + "-" + m.MsgType
+		}
+	case "bad_dndf":
+		if m.TracknetBadDnDfMsg.MsgID != "" && m.TracknetBadDnDfMsg.MsgID != "0" {
+			return string(m.TracknetBadDnDfMsg.MsgID) + "-" + m.MsgType
+		}
+	case "dnclr":
+		// dnclr of the whole device queue comes with MsgId 0
+		if m.TracknetDnClrMsg.MsgID != "" && m.TracknetDnClrMsg.MsgID != "0" {
+			return string(m.TracknetDnClrMsg.MsgID) + "-" + m.MsgType
+		}
+	}
+	sum := sha1.Sum(raw)
+	return hex.EncodeToString(sum[:])
+}
+
 // GetMessage func
 func (m *TrackNetMessage) GetMessage() map[string]interface{} {
 
@@ -722,8 +777,22 @@ func (ctx *Context) SinkQueue(queue []AppxMessage) {
 			logger.Errorf("Error unmarshaling upcoming message: %s", err)
 			continue
 		}
+		switch event.MsgType {
+		case "updf", "upinfo", "joining", "joined":
+			if affinity.Learn(event.DevEui, appxMsg.AppxID) && ctx.outbox.Waits(event.DevEui) {
+				go ctx.FlushOutbox()
+			}
+			radio.Learn(&event)
+			if event.MsgType == "updf" {
+				ctx.scheduler.Uplink(event.DevEui)
+			}
+		case "dntxed", "dnacked", "bad_dndf", "dnclr":
+			ctx.downlinkStatusChanged(ledger.Track(&event)...)
+		}
 		if ok := ctx.FilterMessage(&event); ok {
 			msg = event.GetMessage()
+			msg["id"] = event.GetID(appxMsg.Message)
+			msg["appxid"] = appxMsg.AppxID
 			switch event.MsgType {
 			case "dndf":
 				break
@@ -744,9 +813,16 @@ func (ctx *Context) SinkQueue(queue []AppxMessage) {
 			default:
 				if event.GetFRMPayload() != "" {
 					messagesHittedDecoder.Inc()
-					payload := ctx.DecodePayload(event.GetDevEui() /*event.TracknetUpDfMsg.FRMPayload*/, event.GetFRMPayload())
+					payload, decoder, err := ctx.DecodePayload(UplinkInput{event.GetDevEui(), event.GetFPort(), event.GetFRMPayload()})
+					if skipped, ok := err.(*skippedFPortError); ok {
+						msg["decode_skipped"] = skipped.FPort
+					} else if err != nil {
+						msg["decode_error"] = err.Error()
+					}
 					if payload != nil {
 						msg["payload"] = &payload
+						msg["decoder_type"] = decoder.Type
+						msg["decoder_version"] = decoder.Version
 						messagesDecoded.Inc()
 					} else {
 						messagesLeavedWithoutDecoding.Inc()
@@ -783,8 +859,12 @@ func (ctx *Context) rethinkSink(batch *[]interface{}) {
 
 	ctx.CheckRethinkAlive()
 	r := re.DB(ctx.RethinkDB.DB).Table(ctx.RethinkDB.Collection)
+	docs := make([]interface{}, 0, len(*batch))
+	for _, each := range *batch {
+		docs = append(docs, encodeRecordPositions(each, reqlPosition))
+	}
 	start := time.Now()
-	_, err := r.Insert(batch).RunWrite(ctx.reSession)
+	_, err := r.Insert(docs, re.InsertOpts{Conflict: "replace"}).RunWrite(ctx.reSession)
 	if err != nil {
 		logger.Errorf("RethinkDB insetrion failed with: %+v", err)
 		rethinkInsertFailed.Add(float64(len(*batch)))
@@ -797,44 +877,73 @@ func (ctx *Context) rethinkSink(batch *[]interface{}) {
 
 func (ctx *Context) elasticSink(batch *[]interface{}) {
 
-	bulkRequest := ctx.esClient.Bulk()
+	docs := make([]elasticDoc, 0, len(*batch))
 	for _, each := range *batch {
-		req := elastic.NewBulkIndexRequest().Index(time.Now().Format(ctx.Elastic.Index)).Type("logs"). /*.Id(id.String())*/ Doc(each)
-		bulkRequest = bulkRequest.Add(req)
+		docs = append(docs, ctx.elasticDocument(each))
 	}
 
 	start := time.Now()
-	_, err := bulkRequest.Do(context.Background())
-	if err != nil {
-		logger.Errorf("ElasticSearch Do request failed: %v", err)
-		elasticInsertFailed.Add(float64(len(*batch)))
-	} else {
-		messagesStoredInElastic.Add(float64(len(*batch)))
+	for attempt := 0; len(docs) > 0; attempt++ {
+		bulkRequest := ctx.esClient.Bulk()
+		for _, doc := range docs {
+			req := elastic.NewBulkIndexRequest().Index(doc.Index).Type(elasticDocType).Id(doc.ID).Doc(doc.Doc)
+			bulkRequest = bulkRequest.Add(req)
+		}
+
+		resp, err := bulkRequest.Do(context.Background())
+		if err != nil && attempt < ctx.Elastic.MaxRetries && elasticRequestRetryable(err) {
+			logger.Warnf("ElasticSearch Do request failed: %v, retry %v of %v", err, attempt+1, ctx.Elastic.MaxRetries)
+			elasticBulkRetries.Add(float64(len(docs)))
+			time.Sleep(time.Duration(ctx.Elastic.RetryBackoff*int64(attempt+1)) * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			logger.Errorf("ElasticSearch Do request failed: %v", err)
+			elasticBulkItems.WithLabelValues("none", "request_failed").Add(float64(len(docs)))
+			elasticInsertFailed.Add(float64(len(docs)))
+			for _, doc := range docs {
+				ctx.esFailures.Write(doc, 0, "request_failed", err.Error())
+			}
+			break
+		}
+
+		docs = ctx.elasticBulkResult(docs, resp, attempt < ctx.Elastic.MaxRetries)
+		if len(docs) > 0 {
+			logger.Warnf("ElasticSearch rejected %v documents with retryable status, retry %v of %v", len(docs), attempt+1, ctx.Elastic.MaxRetries)
+			elasticBulkRetries.Add(float64(len(docs)))
+			time.Sleep(time.Duration(ctx.Elastic.RetryBackoff*int64(attempt+1)) * time.Millisecond)
+		}
 	}
 	duration := time.Since(start)
 	elasticPublishHistogram.Observe(float64(duration.Nanoseconds() / int64(time.Millisecond)))
 }
 
 func (ctx *Context) mqttSink(batch *[]interface{}) {
-	events, err := json.Marshal(*batch)
+	if ctx.Mqtt.Mode == mqttModeEvent {
+		ctx.mqttEventSink(batch)
+		return
+	}
+
+	docs := make([]interface{}, 0, len(*batch))
+	for _, each := range *batch {
+		docs = append(docs, encodeRecordPositions(each, geoJSONPosition))
+	}
+	events, err := json.Marshal(docs)
 	if err != nil {
 		log.Errorf("Can't convert batch to json string: %+v", err)
 		return
 	}
 
 	start := time.Now()
-	if token := ctx.mqttClient.Publish(ctx.Mqtt.UpTopic, ctx.Mqtt.UpQoS, false, string(events)); token.Wait() && token.Error() != nil {
-		logger.Errorf("Failed to publish to MQTT: %+v", token.Error())
-		mqttPublishFailed.Add(float64(len(*batch)))
-	} else {
-		messagesPublishedToMqtt.Add(float64(len(*batch)))
-	}
+	published, _, failed := ctx.mqttPublishAll([]mqttMessage{{ctx.Mqtt.UpTopic, ctx.Mqtt.UpQoS, false, events, len(*batch)}})
+	messagesPublishedToMqtt.Add(float64(published))
+	mqttPublishFailed.Add(float64(failed))
 	duration := time.Since(start)
 	mqttPublishHistogram.Observe(float64(duration.Nanoseconds() / int64(time.Millisecond)))
 }
 
-// handleMqttUpMessage
-func (p *connPool) handleMqttDnMessage(c mqtt.Client, m mqtt.Message) {
+// handleMqttDnMessage
+func (ctx *Context) handleMqttDnMessage(c mqtt.Client, m mqtt.Message) {
 	var dnMsg []TracknetDnDfSpecialMsg
 	if err := json.Unmarshal(m.Payload(), &dnMsg); err != nil {
 		logger.Errorf("Can't umrashall incoming dndf %s, %+v", string(m.Payload()), err)
@@ -843,20 +952,19 @@ func (p *connPool) handleMqttDnMessage(c mqtt.Client, m mqtt.Message) {
 	messagesReceivedFromMqtt.Add(float64(len(dnMsg)))
 	logger.Infof("Downcoming message: %+v", dnMsg)
 	for _, msg := range dnMsg {
-		if msg.DevEui == "" || msg.MsgType != "dndf" {
+		if msg.MsgType != "dndf" {
 			logger.Errorf("Incorrect incoming dndf message %s, dropping", string(m.Payload()))
 			messagesDroppedFromMqtt.WithLabelValues("incorrect_fmt").Inc()
 		} else {
-			var randConn *connection
-			for conn := range p.connections {
-				randConn = conn
-				break
-			}
-			if err := randConn.ws.WriteJSON(msg); err != nil {
-				logger.Errorf("Fail to send dn message %+v", err)
+			err := ctx.SubmitDownlink(&msg)
+			if _, invalid := err.(*DownlinkError); invalid {
+				logger.WithFields(log.Fields{"DevEui": msg.DevEui}).Errorf("Invalid dn message %+v", err)
+				messagesDroppedFromMqtt.WithLabelValues("invalid").Inc()
+			} else if err == errNoConnection {
+				logger.WithFields(log.Fields{"DevEui": msg.DevEui}).Errorf("Fail to send dn message %+v", err)
+				messagesDroppedFromMqtt.WithLabelValues("no_connection").Inc()
+			} else if err != nil {
 				messagesDroppedFromMqtt.WithLabelValues("ws_error").Inc()
-			} else {
-				messagesForwardedToTcio.WithLabelValues(randConn.appxID, randConn.appxURI).Inc()
 			}
 		}
 	}
@@ -864,17 +972,36 @@ func (p *connPool) handleMqttDnMessage(c mqtt.Client, m mqtt.Message) {
 }
 
 // DecodePayload func
-func (ctx *Context) DecodePayload(deveui string, payload string) interface{} {
+// decoder used is returned along, records tell which logic produced the payload,
+// decoders run guarded and keep failing ones are quarantined
+func (ctx *Context) DecodePayload(in UplinkInput) (interface{}, Decoder, error) {
+	deveui, payload := in.DevEui, in.FRMPayload
 	if devType, ok := ctx.Inventory[deveui]; ok {
-		if decoder, ok := ctx.DecodingPlugins[devType]; ok {
-			payload, err := decoder(payload)
+		registry := ctx.Registry()
+		decoderType, ok := registry.Route(devType, in.FPort)
+		if !ok {
+			return nil, Decoder{}, ctx.decodingSkipped(devType, in)
+		}
+		if decoder, ok := registry.Decoder(decoderType); ok {
+			if err := ctx.quarantine.Check(decoderType, deveui); err != nil {
+				messagesDecodingQuarantined.Inc()
+				return nil, decoder, err
+			}
+			payload, reason, err := guardedDecode(decoder, in, time.Duration(ctx.Decoders.Deadline)*time.Millisecond)
+			if _, ok := err.(*skippedFPortError); ok {
+				return nil, decoder, ctx.decodingSkipped(devType, in)
+			}
 			if err != nil {
-				logger.WithFields(log.Fields{"DevEui": deveui, "type": devType}).Errorf("Error decoding %+v", err)
+				logger.WithFields(log.Fields{"DevEui": deveui, "type": decoderType, "version": decoder.Version, "FPort": in.FPort}).Errorf("Error decoding %+v", err)
 				messagesDecodingFailed.Inc()
+				decoderFailures.WithLabelValues(decoderType, reason).Inc()
+				ctx.quarantine.Failure(decoderType, deveui)
+			} else {
+				ctx.quarantine.Success(decoderType, deveui)
 			}
-			return payload
+			return payload, decoder, err
 		} /*else {*/
-		logger.WithFields(log.Fields{"DevEui": deveui, "type": devType, "payload": payload}).Errorln("Decored not found")
+		logger.WithFields(log.Fields{"DevEui": deveui, "type": decoderType, "payload": payload}).Errorln("Decored not found")
 		messagesDecoderNotFound.Inc()
 		//}
 	} /*else {
@@ -882,5 +1009,13 @@ func (ctx *Context) DecodePayload(deveui string, payload string) interface{} {
 			logger.WithFields(log.Fields{"DevEui": deveui, "payload": payload}).Errorln("Device not listed in inventory")
 		}
 	}*/
-	return nil
+	return nil, Decoder{}, nil
+}
+
+// decodingSkipped func
+// port not meant for decoding is neither decoder nor device failure
+func (ctx *Context) decodingSkipped(devType string, in UplinkInput) error {
+	logger.WithFields(log.Fields{"DevEui": in.DevEui, "type": devType, "FPort": in.FPort}).Debugln("FPort is not decoded")
+	messagesDecodingSkipped.WithLabelValues(devType, strconv.Itoa(int(in.FPort))).Inc()
+	return &skippedFPortError{in.FPort}
 }
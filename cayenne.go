@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+func init() {
+	RegisterDecoder(Decoder{Type: "cayenne_lpp", Version: "1", Decode: DecodeCayenneLPP})
+}
+
+/*
+Cayenne Low Power Payload, Data Channel (1-Byte) | Data Type (1-Byte) | Data (N-Bytes), big endian
+Type				LPP		Data Size	Data Resolution per bit
+Digital Input		0		1			1
+Digital Output		1		1			1
+Analog Input		2		2			0.01 Signed
+Analog Output		3		2			0.01 Signed
+Illuminance Sensor	101		2			1 Lux Unsigned MSB
+Presence Sensor		102		1			1
+Temperature Sensor	103		2			0.1 °C Signed MSB
+Humidity Sensor		104		1			0.5 % Unsigned
+Accelerometer		113		6			0.001 G Signed MSB per axis
+Barometer			115		2			0.1 hPa Unsigned MSB
+Gyrometer			134		6			0.01 °/s Signed MSB per axis
+GPS Location		136		9			Latitude : 0.0001 ° Signed MSB, Longitude : 0.0001 ° Signed MSB, Altitude : 0.01 meter Signed MSB
+*/
+
+type cayenneType struct {
+	Name     string
+	DataSize int
+}
+
+var cayenneTypes = map[byte]cayenneType{
+	0:   {"digital_input", 1},
+	1:   {"digital_output", 1},
+	2:   {"analog_input", 2},
+	3:   {"analog_output", 2},
+	101: {"illuminance", 2},
+	102: {"presence", 1},
+	103: {"temperature", 2},
+	104: {"humidity", 1},
+	113: {"accelerometer", 6},
+	115: {"barometer", 2},
+	134: {"gyrometer", 6},
+	136: {"gps", 9},
+}
+
+// DecodeCayenneLPP func
+// values are keyed <type>_<channel>, e.g. temperature_3, locations are Position as with TrackNet trackers
+func DecodeCayenneLPP(payload string) (interface{}, error) {
+	decoded := make(map[string]interface{})
+
+	byteData, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload %s is not hex: %v", payload, err)
+	}
+
+	for offset := 0; offset < len(byteData); {
+		if offset+2 > len(byteData) {
+			return decoded, &decodeError{offset, "truncated channel header"}
+		}
+		channel := byteData[offset]
+		lpp, ok := cayenneTypes[byteData[offset+1]]
+		if !ok {
+			return decoded, &decodeError{offset + 1, fmt.Sprintf("unknown data type %d", byteData[offset+1])}
+		}
+		if offset+2+lpp.DataSize > len(byteData) {
+			return decoded, &decodeError{offset + 2, fmt.Sprintf("%s needs %d bytes, %d left", lpp.Name, lpp.DataSize, len(byteData)-offset-2)}
+		}
+		data := byteData[offset+2 : offset+2+lpp.DataSize]
+		key := fmt.Sprintf("%s_%d", lpp.Name, channel)
+
+		switch lpp.Name {
+		case "digital_input", "digital_output", "presence":
+			decoded[key] = int(data[0])
+		case "analog_input", "analog_output":
+			decoded[key] = float64(signedInt(data)) * 0.01
+		case "illuminance":
+			decoded[key] = int(unsignedInt(data))
+		case "temperature":
+			decoded[key] = float64(signedInt(data)) * 0.1
+		case "humidity":
+			decoded[key] = float64(data[0]) * 0.5
+		case "accelerometer":
+			decoded[key] = map[string]float64{
+				"x": float64(signedInt(data[0:2])) * 0.001,
+				"y": float64(signedInt(data[2:4])) * 0.001,
+				"z": float64(signedInt(data[4:6])) * 0.001,
+			}
+		case "barometer":
+			decoded[key] = float64(unsignedInt(data)) * 0.1
+		case "gyrometer":
+			decoded[key] = map[string]float64{
+				"x": float64(signedInt(data[0:2])) * 0.01,
+				"y": float64(signedInt(data[2:4])) * 0.01,
+				"z": float64(signedInt(data[4:6])) * 0.01,
+			}
+		case "gps":
+			alt := float64(signedInt(data[6:9])) * 0.01
+			decoded[key] = Position{
+				Lat:    float64(signedInt(data[:3])) * 0.0001,
+				Lon:    float64(signedInt(data[3:6])) * 0.0001,
+				Alt:    &alt,
+				Source: "cayenne",
+			}
+		}
+		offset += 2 + lpp.DataSize
+	}
+	return decoded, nil
+}
+
+// unsignedInt func
+// big endian of 1 to 8 bytes
+func unsignedInt(value []byte) uint64 {
+	var u uint64
+	for _, b := range value {
+		u = u<<8 | uint64(b)
+	}
+	return u
+}
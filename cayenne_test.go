@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodeCayenneLPP(t *testing.T) {
+	checkDecoderCases(t, DecodeCayenneLPP, []decoderCase{
+		{"digital input", "030064", map[string]interface{}{"digital_input_3": 100}, -1},
+		{"digital output", "040101", map[string]interface{}{"digital_output_4": 1}, -1},
+		{"analog input negative", "0502FF9C", map[string]interface{}{"analog_input_5": -1.0}, -1},
+		{"analog output", "06030064", map[string]interface{}{"analog_output_6": 1.0}, -1},
+		{"illuminance", "07650100", map[string]interface{}{"illuminance_7": 256}, -1},
+		{"presence", "086601", map[string]interface{}{"presence_8": 1}, -1},
+		{"temperature", "01670110", map[string]interface{}{"temperature_1": 27.2}, -1},
+		{"temperature negative", "0167FF38", map[string]interface{}{"temperature_1": -20.0}, -1},
+		{"humidity", "056828", map[string]interface{}{"humidity_5": 20.0}, -1},
+		{"accelerometer", "067104D2FB2E0000", map[string]interface{}{"accelerometer_6": map[string]interface{}{"x": 1.234, "y": -1.234, "z": 0.0}}, -1},
+		{"barometer", "07732710", map[string]interface{}{"barometer_7": 1000.0}, -1},
+		{"gyrometer", "08860064FF9C0000", map[string]interface{}{"gyrometer_8": map[string]interface{}{"x": 1.0, "y": -1.0, "z": 0.0}}, -1},
+		{"gps", "01880AE9D100B6AB0001F4", map[string]interface{}{"gps_1": position(71.5217, 4.6763, 5.0, "cayenne")}, -1},
+		{"gps negative", "0288FFFFFFF5162FFFFF9C", map[string]interface{}{"gps_2": position(-0.0001, -71.5217, -1.0, "cayenne")}, -1},
+		{"several channels", "01670110056828", map[string]interface{}{"temperature_1": 27.2, "humidity_5": 20.0}, -1},
+		{"empty", "", map[string]interface{}{}, -1},
+		{"truncated header", "01", map[string]interface{}{}, 0},
+		{"truncated value", "016701", map[string]interface{}{}, 2},
+		{"truncated value after channel", "016701100267", map[string]interface{}{"temperature_1": 27.2}, 6},
+		{"unknown type", "01FF00", map[string]interface{}{}, 1},
+	})
+}
+
+func FuzzDecodeCayenneLPP(f *testing.F) {
+	for _, seed := range []string{
+		"030064", "0502FF9C", "07650100", "01670110", "056828", "067104D2FB2E0000",
+		"07732710", "08860064FF9C0000", "01880AE9D100B6AB0001F4", "01670110056828",
+		"", "01", "016701", "01FF00",
+	} {
+		data, _ := hex.DecodeString(seed)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecodeOffset(t, DecodeCayenneLPP, data)
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+// RunCommand func
+// subcommands given after flags, false if there is none and proxy should start
+func RunCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "validate-spec":
+		os.Exit(validateSpecs(args[1:]))
+	case "decode":
+		os.Exit(decodeCommand(args[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", args[0])
+		os.Exit(2)
+	}
+	return true
+}
+
+// validateSpecs func
+// loads spec decoders and checks them against their samples
+func validateSpecs(files []string) int {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: validate-spec spec.yaml [spec.yaml...]")
+		return 2
+	}
+
+	status := 0
+	for _, file := range files {
+		spec, err := LoadPayloadSpec(file)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			status = 1
+			continue
+		}
+		failures := spec.Validate()
+		for _, failure := range failures {
+			fmt.Printf("FAIL %s: %s\n", file, failure)
+		}
+		if len(failures) > 0 {
+			status = 1
+			continue
+		}
+		fmt.Printf("OK   %s: %s %s, %d samples\n", file, spec.Type, spec.Version, len(spec.Samples))
+	}
+	return status
+}
+
+// decodedUplink type
+// one decoded uplink as printed by decode command
+type decodedUplink struct {
+	DevEui  string      `json:"DevEui,omitempty"`
+	FPort   uint8       `json:"FPort"`
+	Type    string      `json:"type,omitempty"`
+	Version string      `json:"version,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+	Skipped bool        `json:"skipped,omitempty"` // FPort is not decoded for the device type
+	Error   string      `json:"error,omitempty"`
+	Offset  *int        `json:"offset,omitempty"` // byte where decoding failed, when decoder tells
+}
+
+// decodeCommand func
+// decodes payload or JSONL of TrackNet messages offline, with the same decoders proxy would load
+func decodeCommand(args []string) int {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	devType := flags.String("type", "", "device type, taken from config inventory by DevEui if empty")
+	deveui := flags.String("deveui", "", "device DevEui")
+	fport := flags.Uint("fport", 0, "uplink FPort")
+	path := flags.String("decoders", "", "decoders path, config one if empty")
+	file := flags.String("file", "", "JSONL file of TrackNet messages, - for stdin")
+	isHex := flags.Bool("hex", false, "payload is hex")
+	isBase64 := flags.Bool("base64", false, "payload is base64")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: decode (--type type | --deveui DevEui) [--fport port] [--hex | --base64] payload")
+		fmt.Fprintln(os.Stderr, "       decode [--type type] --file messages.jsonl")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" && (flags.NArg() != 1 || (*devType == "" && *deveui == "")) {
+		flags.Usage()
+		return 2
+	}
+	if *fport > 255 {
+		fmt.Fprintf(os.Stderr, "FPort %d is out of range\n", *fport)
+		return 2
+	}
+
+	// decoded json owns stdout
+	if *logFile == "stdout" {
+		logger.Out = os.Stderr
+	}
+
+	ctx := Context{}
+	if raw, err := ioutil.ReadFile(*confFile); err == nil {
+		if err := yaml.Unmarshal(raw, &ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't parse config file %s: %v\n", *confFile, err)
+			return 2
+		}
+	} else if *devType == "" {
+		fmt.Fprintf(os.Stderr, "Can't load config file %s for inventory: %v\n", *confFile, err)
+		return 2
+	}
+	if *path != "" {
+		ctx.Decoders.Path = *path
+	}
+	ctx.decodersDefaults()
+	registry, err := buildRegistry(ctx.Decoders)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't load decoders from %s: %v\n", ctx.Decoders.Path, err)
+		return 2
+	}
+	ctx.registry.Store(registry)
+
+	if *file != "" {
+		return ctx.decodeMessages(*file, *devType)
+	}
+
+	if *isHex && *isBase64 {
+		fmt.Fprintln(os.Stderr, "Payload is either --hex or --base64")
+		return 2
+	}
+	payload, err := commandPayload(flags.Arg(0), *isHex, *isBase64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad payload: %v\n", err)
+		return 2
+	}
+	result := ctx.decodeOffline(UplinkInput{*deveui, uint8(*fport), payload}, *devType)
+	if result.Skipped {
+		fmt.Fprintf(os.Stderr, "FPort %d is not decoded for %s\n", result.FPort, result.Type)
+		return 0
+	}
+	if result.Error != "" {
+		fmt.Fprintf(os.Stderr, "%s %s failed: %s\n", result.Type, result.Version, result.Error)
+		if result.Offset != nil {
+			fmt.Fprint(os.Stderr, payloadMarker(payload, *result.Offset))
+		}
+		return 1
+	}
+	out, _ := json.MarshalIndent(result.Payload, "", "  ")
+	fmt.Println(string(out))
+	return 0
+}
+
+// decodeMessages func
+// prints decoded uplink per message carrying payload, downlinks and the rest are skipped
+func (ctx *Context) decodeMessages(file string, devType string) int {
+	input := os.Stdin
+	if file != "-" {
+		var err error
+		if input, err = os.Open(file); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't open %s: %v\n", file, err)
+			return 2
+		}
+		defer input.Close()
+	}
+
+	status := 0
+	out := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		event := TrackNetMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", file, line, err)
+			status = 1
+			continue
+		}
+		if event.MsgType == "dndf" || event.GetFRMPayload() == "" {
+			continue
+		}
+		result := ctx.decodeOffline(UplinkInput{event.GetDevEui(), event.GetFPort(), event.GetFRMPayload()}, devType)
+		if result.Error != "" {
+			status = 1
+		}
+		out.Encode(result)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't read %s: %v\n", file, err)
+		return 2
+	}
+	return status
+}
+
+// decodeOffline func
+// same decoder routing and guard as DecodePayload, without quarantine and metrics
+func (ctx *Context) decodeOffline(in UplinkInput, devType string) decodedUplink {
+	result := decodedUplink{DevEui: in.DevEui, FPort: in.FPort, Type: devType}
+	if result.Type == "" {
+		var ok bool
+		if result.Type, ok = ctx.Inventory[in.DevEui]; !ok {
+			result.Error = "device not listed in inventory"
+			return result
+		}
+	}
+	decoderType, ok := ctx.Registry().Route(result.Type, in.FPort)
+	if !ok {
+		result.Skipped = true
+		return result
+	}
+	decoder, ok := ctx.Registry().Decoder(decoderType)
+	if !ok {
+		result.Error = "decoder not found"
+		return result
+	}
+	result.Type, result.Version = decoder.Type, decoder.Version
+
+	payload, _, err := guardedDecode(decoder, in, time.Duration(ctx.Decoders.Deadline)*time.Millisecond)
+	result.Payload = payload
+	if _, ok := err.(*skippedFPortError); ok {
+		result.Skipped, result.Payload = true, nil
+	} else if err != nil {
+		result.Error = err.Error()
+		if failed, ok := err.(*decodeError); ok {
+			result.Offset = &failed.Offset
+		}
+	}
+	return result
+}
+
+// commandPayload func
+// hex as TrackNet sends it, or base64 as most network servers and consoles show it,
+// without the flag the encoding is guessed only when the payload can't be read the other way
+func commandPayload(payload string, isHex bool, isBase64 bool) (string, error) {
+	payload = strings.Join(strings.Fields(payload), "")
+	fromHex, hexErr := hex.DecodeString(payload)
+	fromBase64, base64Err := base64.StdEncoding.DecodeString(payload)
+	switch {
+	case isHex && hexErr != nil:
+		return "", fmt.Errorf("%s is not hex: %v", payload, hexErr)
+	case isBase64 && base64Err != nil:
+		return "", fmt.Errorf("%s is not base64: %v", payload, base64Err)
+	case isHex:
+	case isBase64:
+		fromHex = fromBase64
+	case hexErr == nil && base64Err == nil:
+		return "", fmt.Errorf("%s is both hex and base64, give --hex or --base64", payload)
+	case base64Err == nil:
+		fromHex = fromBase64
+	case hexErr != nil:
+		return "", fmt.Errorf("%s is neither hex nor base64", payload)
+	}
+	return strings.ToUpper(hex.EncodeToString(fromHex)), nil
+}
+
+// payloadMarker func
+// payload bytes with the failing one pointed at
+func payloadMarker(payload string, offset int) string {
+	var bytes, marker []string
+	for i := 0; i+2 <= len(payload); i += 2 {
+		bytes = append(bytes, payload[i:i+2])
+		if i/2 == offset {
+			marker = append(marker, "^^")
+		} else {
+			marker = append(marker, "  ")
+		}
+	}
+	if offset >= len(bytes) {
+		// decoder ran out of bytes
+		bytes = append(bytes, "..")
+		marker = append(marker, "^^")
+	}
+	return fmt.Sprintf("  %s\n  %s byte %d\n", strings.Join(bytes, " "), strings.TrimRight(strings.Join(marker, " "), " "), offset)
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"crypto/tls"
 	"io/ioutil"
-	"path/filepath"
-	"plugin"
 	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
@@ -16,14 +15,26 @@ import (
 	es "gopkg.in/olivere/elastic.v5"
 )
 
+// DecodersConfig type
+// passed to buildRegistry by value, reloads must not read Context fields being reloaded
+type DecodersConfig struct {
+	Path        string `yaml:"path"`
+	Timeout     int64  `yaml:"timeout"`      // ms per script decoder call
+	MemoryLimit int64  `yaml:"memory_limit"` // MB allocated per script decoder call, approximate, -1 disables
+	Watch       int64  `yaml:"watch"`        // seconds between checks of decoders path for changes, 0 is SIGHUP only
+	Deadline    int64  `yaml:"deadline"`     // ms any decoder call may take
+	Quarantine  int    `yaml:"quarantine"`   // failures in a row before device, or distinct failing devices before decoder type is quarantined, -1 disables
+	Cooldown    int64  `yaml:"cooldown"`     // seconds of quarantine
+	// device type to FPort ("*" for any other) to decoder type, empty decoder type leaves the port undecoded
+	FPorts map[string]map[string]string `yaml:"fports"`
+}
+
 // Context type
 type Context struct {
-	AppName  string `yaml:"appname"`
-	Version  int    `yaml:"version"`
-	Decoders struct {
-		Path string `yaml:"path"`
-	} `yaml:"decoders"`
-	Owner struct {
+	AppName  string         `yaml:"appname"`
+	Version  int            `yaml:"version"`
+	Decoders DecodersConfig `yaml:"decoders"`
+	Owner    struct {
 		ID               string   `yaml:"id"`
 		AppxBootstrapURI string   `yaml:"appx_bootstrap_uri"`
 		StoragePrefList  []string `yaml:"storage_pref_list"`
@@ -45,34 +56,72 @@ type Context struct {
 		Collection string   `yaml:"collection"`
 		InitialCap int      `yaml:"initial_cap"`
 		MaxOpen    int      `yaml:"max_open"`
+		Provision  bool     `yaml:"provision"`
+		Shards     int      `yaml:"shards"`
+		Replicas   int      `yaml:"replicas"`
+		GeoField   string   `yaml:"geo_field"`
 	} `yaml:"rethinkdb"`
 	Elastic struct {
-		Hosts []string `yaml:"hosts"`
-		Index string   `yaml:"index"`
+		Hosts        []string `yaml:"hosts"`
+		Index        string   `yaml:"index"`
+		Template     string   `yaml:"template"`
+		MaxRetries   int      `yaml:"max_retries"` // 3 by default, -1 disables
+		RetryBackoff int64    `yaml:"retry_backoff"`
+		FailureLog   string   `yaml:"failure_log"`
 	} `yaml:"elastic"`
 	Mqtt struct {
-		Brokers     []string `yaml:"brokers"`
-		Certificate string   `yaml:"certificate"`
-		PrivateKey  string   `yaml:"private_key"`
-		User        string   `yaml:"user"`
-		Password    string   `yaml:"password"`
-		DnTopic     string   `yaml:"dntopic"`
-		UpTopic     string   `yaml:"uptopic"`
-		UpQoS       byte     `yaml:"upqos"`
-		DnQoS       byte     `yaml:"dnqos"`
+		Brokers       []string `yaml:"brokers"`
+		CA            string   `yaml:"ca"`
+		Certificate   string   `yaml:"certificate"`
+		PrivateKey    string   `yaml:"private_key"`
+		User          string   `yaml:"user"`
+		Password      string   `yaml:"password"`
+		DnTopic       string   `yaml:"dntopic"`
+		UpTopic       string   `yaml:"uptopic"`
+		UpQoS         byte     `yaml:"upqos"`
+		DnQoS         byte     `yaml:"dnqos"`
+		Mode          string   `yaml:"mode"`
+		Topic         string   `yaml:"topic"`
+		StateTopic    string   `yaml:"state_topic"`
+		Payload       string   `yaml:"payload"`
+		ClientID      string   `yaml:"client_id"`
+		Store         string   `yaml:"store"`
+		OfflineBuffer int      `yaml:"offline_buffer"` // messages, 1000 by default, -1 disables
 	} `yaml:"mqtt"`
+	API struct {
+		Keys []string `yaml:"keys"`
+	} `yaml:"api"`
+	Downlinks struct {
+		Affinity    map[string]string `yaml:"affinity"`
+		Fallback    string            `yaml:"fallback"`
+		StatusTopic string            `yaml:"status_topic"`
+		Outbox      string            `yaml:"outbox"`      // file keeping undelivered downlinks over restarts
+		OutboxTTL   int64             `yaml:"outbox_ttl"`  // seconds
+		Jobs        string            `yaml:"jobs"`        // file keeping scheduled downlinks over restarts
+		Policy      string            `yaml:"policy"`      // replace or append jobs waiting for the same device
+		DeviceGap   int64             `yaml:"device_gap"`  // seconds between downlinks to the same device
+		GlobalRate  float64           `yaml:"global_rate"` // scheduled downlinks per second, 0 is unlimited
+	} `yaml:"downlinks"`
 	Filters struct {
 		DevEui  []string `yaml:"deveui"`
 		MsgType []string `yaml:"msg_type"`
 	} `yaml:"filters"`
-	Inventory        map[string]string `yaml:"inventory"`
-	DecodingPlugins  map[string]func(string) (interface{}, error)
+	Inventory        map[string]string   `yaml:"inventory"`
+	Tags             map[string][]string `yaml:"tags"` // tag to DevEuis, for group downlinks
 	Appxs            TCIOInstance
 	CompilledFilters *DevEuiFilters
 	reSession        *re.Session
 	esClient         *es.Client
+	esFailures       *failureLog
+	registry         atomic.Value // *decoderRegistry
+	decodersMu       sync.Mutex   // serializes decoder reloads with fports updates of config reload
+	quarantine       *quarantineTable
+	outbox           *downlinkOutbox
+	scheduler        *downlinkScheduler
 	mqttClient       mqtt.Client
 	mqttOptions      *mqtt.ClientOptions
+	mqttOffline      *mqttBuffer
+	statusOut        chan mqttMessage // downlink statuses waiting for PublishStatuses
 }
 
 // TCIOInstance type
@@ -96,11 +145,6 @@ type DevEuiFilters struct {
 	//mu            sync.Mutex
 }
 
-type Decoder struct {
-	Type    string
-	Version string
-}
-
 //var devEuiFilters *DevEuiFilters
 
 // CreateContext func
@@ -117,10 +161,55 @@ func CreateContext(config string) *Context {
 		logger.WithFields(log.Fields{"config": config}).Fatalf("Can't parse config file %+v", err)
 	}
 
+	switch ctx.Downlinks.Fallback {
+	case "":
+		ctx.Downlinks.Fallback = fallbackAny
+	case fallbackAny, fallbackBroadcast, fallbackDrop:
+	default:
+		logger.WithFields(log.Fields{"config": config}).Fatalf("Unknown downlinks fallback policy %s", ctx.Downlinks.Fallback)
+	}
+
+	ctx.decodersDefaults()
+
+	if ctx.Downlinks.OutboxTTL == 0 {
+		ctx.Downlinks.OutboxTTL = 3600
+	}
+	ctx.outbox = newDownlinkOutbox(ctx.Downlinks.Outbox, time.Duration(ctx.Downlinks.OutboxTTL)*time.Second)
+
+	switch ctx.Downlinks.Policy {
+	case "":
+		ctx.Downlinks.Policy = pendingReplace
+	case pendingReplace, pendingAppend:
+	default:
+		logger.WithFields(log.Fields{"config": config}).Fatalf("Unknown downlinks policy %s", ctx.Downlinks.Policy)
+	}
+	ctx.statusOut = make(chan mqttMessage, downlinkStatusBacklog)
+	ctx.scheduler = newDownlinkScheduler(ctx.Downlinks.Jobs, ctx.Downlinks.Policy, time.Duration(ctx.Downlinks.DeviceGap)*time.Second, ctx.Downlinks.GlobalRate)
+
 	ctx.CompileFilters()
 	return &ctx
 }
 
+// decodersDefaults func
+func (ctx *Context) decodersDefaults() {
+	if ctx.Decoders.Timeout == 0 {
+		ctx.Decoders.Timeout = 100
+	}
+	if ctx.Decoders.MemoryLimit == 0 {
+		ctx.Decoders.MemoryLimit = 32
+	}
+	if ctx.Decoders.Deadline == 0 {
+		ctx.Decoders.Deadline = 1000
+	}
+	if ctx.Decoders.Quarantine == 0 {
+		ctx.Decoders.Quarantine = 5
+	}
+	if ctx.Decoders.Cooldown == 0 {
+		ctx.Decoders.Cooldown = 300
+	}
+	ctx.quarantine = newQuarantineTable(ctx.Decoders.Quarantine, time.Duration(ctx.Decoders.Cooldown)*time.Second)
+}
+
 // InitBackends func
 func (ctx *Context) InitBackends() {
 	for _, storage := range ctx.Owner.StoragePrefList {
@@ -137,6 +226,12 @@ func (ctx *Context) InitBackends() {
 				if err != nil {
 					logger.Fatalf("Error connecting to %s %+v", storage, err)
 				}
+				if ctx.RethinkDB.Provision {
+					if ctx.RethinkDB.GeoField == "" {
+						ctx.RethinkDB.GeoField = "payload.gps.location"
+					}
+					ctx.ProvisionRethink()
+				}
 				break
 			}
 			logger.Fatalf("%s listed in pipeline but not configured: %+v", storage, ctx.RethinkDB)
@@ -147,40 +242,55 @@ func (ctx *Context) InitBackends() {
 				if err != nil {
 					logger.Fatalf("Error connecting to %s %+v", storage, err)
 				}
+				switch {
+				case ctx.Elastic.MaxRetries == 0:
+					ctx.Elastic.MaxRetries = 3
+				case ctx.Elastic.MaxRetries < 0:
+					// -1 disables retries
+					ctx.Elastic.MaxRetries = 0
+				}
+				if ctx.Elastic.RetryBackoff == 0 {
+					ctx.Elastic.RetryBackoff = 500
+				}
+				ctx.esFailures = newFailureLog(ctx.Elastic.FailureLog)
+				ctx.InstallElasticTemplate()
 				break
 			}
 			logger.Fatalf("%s listed in pipeline but not configured: %+v", storage, ctx.Elastic)
 			break
 		case "mqtt":
-			if len(ctx.Mqtt.Brokers) != 0 && ctx.Mqtt.User != "" && ctx.Mqtt.Password != "" && ctx.Mqtt.DnTopic != "" && ctx.Mqtt.UpTopic != "" {
-				for _, broker := range ctx.Mqtt.Brokers {
-					ctx.mqttOptions = mqtt.NewClientOptions().AddBroker(broker)
+			if len(ctx.Mqtt.Brokers) != 0 && ctx.Mqtt.DnTopic != "" && ctx.Mqtt.UpTopic != "" {
+				if ctx.Mqtt.Mode == "" {
+					ctx.Mqtt.Mode = mqttModeBatch
 				}
-
-				cer, err := tls.LoadX509KeyPair(ctx.Mqtt.Certificate, ctx.Mqtt.PrivateKey)
-				if err != nil {
-					logger.Fatalf("Something goes wrong with MQTT SSL certs loading %+v", err)
+				if ctx.Mqtt.Topic == "" {
+					ctx.Mqtt.Topic = defaultMqttTopic
+				}
+				if ctx.Mqtt.Payload == "" {
+					ctx.Mqtt.Payload = mqttPayloadFull
+				}
+				if (ctx.Mqtt.Mode != mqttModeBatch && ctx.Mqtt.Mode != mqttModeEvent) || (ctx.Mqtt.Payload != mqttPayloadFull && ctx.Mqtt.Payload != mqttPayloadDecoded) {
+					logger.Fatalf("Unknown mqtt mode %s or payload format %s", ctx.Mqtt.Mode, ctx.Mqtt.Payload)
 				}
 
-				ctx.mqttOptions.SetUsername(ctx.Mqtt.User)
-				ctx.mqttOptions.SetPassword(ctx.Mqtt.Password)
-				ctx.mqttOptions.SetClientID(ctx.AppName)
-				ctx.mqttOptions.SetConnectTimeout(time.Second * 3)
-				ctx.mqttOptions.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cer}, InsecureSkipVerify: true})
-				ctx.mqttOptions.SetConnectionLostHandler(func(c mqtt.Client, err error) {
-					logger.Errorln("Mqtt disconnected, trying to reconnect...")
-					ctx.reconnectMqtt()
-				})
+				if ctx.Mqtt.ClientID == "" {
+					ctx.Mqtt.ClientID = ctx.AppName
+				}
+				switch {
+				case ctx.Mqtt.OfflineBuffer == 0:
+					ctx.Mqtt.OfflineBuffer = 1000
+				case ctx.Mqtt.OfflineBuffer < 0:
+					// -1 disables buffering, messages published while offline are dropped
+					ctx.Mqtt.OfflineBuffer = 0
+				}
 
+				ctx.mqttOffline = newMqttBuffer(ctx.Mqtt.OfflineBuffer)
+				ctx.mqttOptions = ctx.mqttClientOptions()
 				ctx.mqttClient = mqtt.NewClient(ctx.mqttOptions)
 
 				if token := ctx.mqttClient.Connect(); token.Wait() && token.Error() != nil {
 					logger.Fatalf("Error connecting to %s %+v", storage, token.Error())
 				}
-
-				if token := ctx.mqttClient.Subscribe(ctx.Mqtt.DnTopic, ctx.Mqtt.UpQoS, pool.handleMqttDnMessage); token.Wait() && token.Error() != nil {
-					logger.Fatalf("Error subscribe to mqtt uptopic %s: %+v", ctx.Mqtt.UpTopic, token.Error())
-				}
 				break
 			}
 			logger.Fatalf("%s listed in pipeline but not configured: %+v", storage, ctx.Mqtt)
@@ -189,113 +299,17 @@ func (ctx *Context) InitBackends() {
 	}
 }
 
-func (ctx *Context) reconnectMqtt() {
-
-	ticker := time.NewTicker(time.Second * 3)
-	if ctx.mqttClient.IsConnected() {
-		ctx.mqttClient.Disconnect(1000)
-	}
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			logger.Infoln("Trying reconnect to MQTT...")
-			ctx.mqttClient = mqtt.NewClient(ctx.mqttOptions)
-
-			if token := ctx.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-				logger.Errorf("Error connecting to mqtt %+v", token.Error())
-			} else {
-				if token := ctx.mqttClient.Subscribe(ctx.Mqtt.DnTopic, ctx.Mqtt.UpQoS, pool.handleMqttDnMessage); token.Wait() && token.Error() != nil {
-					logger.Errorf("Error subscribe to mqtt uptopic %s: %+v", ctx.Mqtt.UpTopic, token.Error())
-				}
-				ticker.Stop()
-				logger.Infoln("Mqtt reconnected")
-				return
-			}
-		}
-	}
-}
-
-// func (ctx *Context) reconnectMqtt() {
-// 	ticker := time.NewTicker(time.Second * 3)
-// 	if ctx.mqttClient.IsConnected() {
-// 		ctx.mqttClient.Disconnect(1000)
-// 	}
-// 	defer ticker.Stop()
-
-// 	for {
-// 		select {
-// 		case <-ticker.C:
-// 			var opts *mqtt.ClientOptions
-// 			for _, broker := range ctx.Mqtt.Brokers {
-// 				opts = mqtt.NewClientOptions().AddBroker(broker)
-// 			}
-
-// 			/// ADD SSL AUTODETECT
-// 			cer, err := tls.LoadX509KeyPair(ctx.Mqtt.Certificate, ctx.Mqtt.PrivateKey)
-// 			if err != nil {
-// 				logger.Fatalf("Something goes wrong with MQTT SSL certs loading %+v", err)
-// 			}
-
-// 			opts.SetUsername(ctx.Mqtt.User)
-// 			opts.SetPassword(ctx.Mqtt.Password)
-// 			opts.SetClientID(ctx.AppName)
-// 			opts.SetConnectTimeout(time.Second * 3)
-// 			opts.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cer}, InsecureSkipVerify: true})
-// 			opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
-// 				logger.Errorln("Mqtt disconnected, trying to reconnect...")
-// 				ctx.reconnectMqtt()
-// 			})
-
-// 			ctx.mqttClient = mqtt.NewClient(opts)
-
-// 			if token := ctx.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-// 				logger.Errorf("Error connecting to mqtt %+v", token.Error())
-// 				ticker = time.NewTicker(time.Second * 1)
-// 			} else {
-// 				logger.Infoln("Mqtt reconnected")
-// 				if token := ctx.mqttClient.Subscribe(ctx.Mqtt.DnTopic, ctx.Mqtt.UpQoS, pool.handleMqttDnMessage); token.Wait() && token.Error() != nil {
-// 					logger.Errorf("Error subscribe to mqtt uptopic %s: %+v", ctx.Mqtt.UpTopic, token.Error())
-// 				}
-// 				ticker.Stop()
-// 				return
-// 			}
-// 		}
-// 	}
-// }
-
 // LoadDecoders func
 func (ctx *Context) LoadDecoders() {
-	// init decoders map
-	ctx.DecodingPlugins = make(map[string]func(string) (interface{}, error))
-	allDecoders, err := filepath.Glob(ctx.Decoders.Path + "/*.so")
+	registry, err := buildRegistry(ctx.Decoders)
 	if err != nil {
-		logger.WithFields(log.Fields{"path": ctx.Decoders.Path}).Fatalf("Can't list decoders dir: %v", err)
+		logger.WithFields(log.Fields{"path": ctx.Decoders.Path}).Fatalf("Can't load decoders: %v", err)
 	}
-
-	for _, decoder := range allDecoders {
-		// try to load decoder
-		p, err := plugin.Open(decoder)
-		if err != nil {
-			logger.WithFields(log.Fields{"decoder": decoder}).Fatalf("Can't load decoder: %v", err)
-		}
-		// import descriptive type of decoder
-		decoderType, err := p.Lookup("Decoder")
-		if err != nil {
-			logger.WithFields(log.Fields{"decoder": decoder}).Fatalf("Can't import type of decoder: %v", err)
-		}
-		// import decoder method
-		decodeMethod, err := p.Lookup("Decode")
-		if err != nil {
-			logger.WithFields(log.Fields{"decoder": decoder}).Fatalf("Can't import decoder method: %v", err)
-		}
-		ctx.DecodingPlugins[*decoderType.(*string)] = decodeMethod.(func(string) (interface{}, error))
-	}
-
-	for decoderType := range ctx.DecodingPlugins {
-		logger.Infof("Decoder loaded: %s", decoderType)
+	ctx.registry.Store(registry)
+	for devType, decoder := range registry.decoders {
+		logger.WithFields(log.Fields{"type": devType, "version": decoder.Version, "source": decoder.Source, "encoder": decoder.Encode != nil}).Infoln("Decoder loaded")
 	}
+	registry.account()
 }
 
 // CompileFilters func
@@ -327,6 +341,10 @@ func (ctx *Context) ReloadConfig(config string) {
 
 	ctx.Filters = tmp.Filters
 	ctx.Inventory = tmp.Inventory
+	ctx.Tags = tmp.Tags
+	ctx.decodersMu.Lock()
+	ctx.Decoders.FPorts = tmp.Decoders.FPorts
+	ctx.decodersMu.Unlock()
 	ctx.CompileFilters()
 }
 
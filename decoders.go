@@ -1,15 +1,29 @@
 package main
 
 import (
-	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 )
 
-type trackNetGps struct {
+func init() {
+	RegisterDecoder(Decoder{Type: "tracknet_gps", Version: "2", Decode: DecodeTNGps})
+}
+
+// decodeError type
+// malformed payload, Offset points to the byte decoding stopped at
+type decodeError struct {
+	Offset int
+	Reason string
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("offset %d: %s", e.Offset, e.Reason)
+}
+
+type trackNetChannel struct {
 	DataType  byte
 	DataSize  int
 	ValueType string
-	Next      int
 }
 
 /*
@@ -28,66 +42,83 @@ Impact Alarm		0x0C			0x00		1					Digital Input	Boolean
 HP - High Precision
 */
 
+// trackNetChannels by data channel, see the table above
+var trackNetChannels = map[byte]trackNetChannel{
+	0x00: {0xff, 2, "battery"},
+	0x01: {0x88, 9, "gps"},
+	0x02: {0x00, 1, "gps_status"},
+	0x03: {0x89, 8, "gps_hp"},
+	0x05: {0x02, 2, "impact_magnitude"},
+	0x06: {0x00, 1, "break_in"},
+	0x07: {0x71, 6, "accelerometer"},
+	0x0b: {0x67, 2, "mcu_temperature"},
+	0x0c: {0x00, 1, "impact_alarm"},
+}
+
 // DecodeTNGps func
+// values decoded before malformed part of the payload are returned along with the error
 func DecodeTNGps(payload string) (interface{}, error) {
+	decoded := make(map[string]interface{})
 
-	var (
-		decoded = make(map[string]interface{})
-		offset  int
-		format  = map[byte]trackNetGps{
-			0x00: {0xff, 2, "battery", 4},
-			0x01: {0x88, 9, "gps", 11},
-		}
-	)
-
-	byteData, err := hex.DecodeString( /*"018808814705BF070052E400FF0152"*/ payload)
+	byteData, err := hex.DecodeString(payload)
 	if err != nil {
-		logger.Errorf("Error conver payload %s to byte array %+v", payload, err)
-		return nil, err
+		return nil, fmt.Errorf("payload %s is not hex: %v", payload, err)
 	}
 
-	for {
-		if val, ok := format[byteData[offset]]; ok {
-			if byteData[offset+1] == val.DataType {
-				switch val.ValueType {
-				case "battery":
-					tmp := byteData[offset+2 : offset+2+val.DataSize]
-					bits := binary.BigEndian.Uint16(tmp)
-					sign := bits&1 != 0
-					if sign {
-						decoded["battery"] = float64(bits) * -0.01
-						logger.Printf("===battery %f", float64(bits)*-0.01)
-					} else {
-						decoded["battery"] = float64(bits) * 0.01
-						logger.Printf("===battery %f", float64(bits)*0.01)
-					}
-				case "gps":
-					tmp := byteData[offset+2 : offset+2+val.DataSize]
-					lati := threeByteToInt64(tmp[:3])
-					loni := threeByteToInt64(tmp[3:6])
-					alti := threeByteToInt64(tmp[6:9])
-					//decoded["gps"] = []float64{float64(lati) * 0.0001, float64(loni) * 0.0001, float64(alti) * 0.01}
-					decoded["gps"] = map[string]interface{}{
-						"$reql_type$": "GEOMETRY",
-						"coordinates": []float64{float64(lati) * 0.0001, float64(loni) * 0.0001},
-						"type":        "Point",
-					}
-					logger.Printf("===gps %f, %f, %f", float64(lati)*0.0001, float64(loni)*0.0001, float64(alti)*0.01)
-				}
-				offset += val.Next
-			}
+	for offset := 0; offset < len(byteData); {
+		if offset+2 > len(byteData) {
+			return decoded, &decodeError{offset, "truncated channel header"}
+		}
+		channel, ok := trackNetChannels[byteData[offset]]
+		if !ok {
+			return decoded, &decodeError{offset, fmt.Sprintf("unknown data channel 0x%02x", byteData[offset])}
+		}
+		if byteData[offset+1] != channel.DataType {
+			return decoded, &decodeError{offset + 1, fmt.Sprintf("data type 0x%02x doesn't match %s channel, 0x%02x expected", byteData[offset+1], channel.ValueType, channel.DataType)}
 		}
-		if offset == len(byteData) {
-			break
+		if offset+2+channel.DataSize > len(byteData) {
+			return decoded, &decodeError{offset + 2, fmt.Sprintf("%s needs %d bytes, %d left", channel.ValueType, channel.DataSize, len(byteData)-offset-2)}
 		}
+		data := byteData[offset+2 : offset+2+channel.DataSize]
+
+		switch channel.ValueType {
+		case "battery":
+			decoded["battery"] = float64(signedInt(data)) * 0.01
+		case "gps":
+			alt := float64(signedInt(data[6:9])) * 0.01
+			decoded["gps"] = Position{
+				Lat:    float64(signedInt(data[:3])) * 0.0001,
+				Lon:    float64(signedInt(data[3:6])) * 0.0001,
+				Alt:    &alt,
+				Source: "gps",
+			}
+		case "gps_hp":
+			decoded["gps_hp"] = Position{
+				Lat:    float64(signedInt(data[:4])) * 0.0000001,
+				Lon:    float64(signedInt(data[4:8])) * 0.0000001,
+				Source: "gps_hp",
+			}
+		case "impact_magnitude":
+			decoded["impact_magnitude"] = float64(signedInt(data)) * 0.01
+		case "accelerometer":
+			decoded["accelerometer"] = map[string]float64{
+				"x": float64(signedInt(data[0:2])) * 0.01,
+				"y": float64(signedInt(data[2:4])) * 0.01,
+				"z": float64(signedInt(data[4:6])) * 0.01,
+			}
+		case "mcu_temperature":
+			decoded["mcu_temperature"] = float64(signedInt(data)) * 0.1
+		case "gps_status", "break_in", "impact_alarm":
+			decoded[channel.ValueType] = data[0] != 0
+		}
+		offset += 2 + channel.DataSize
 	}
 	return decoded, nil
 }
 
-func threeByteToInt64(value []byte) int {
-	if len(value) != 3 {
-		logger.Errorf("threeByteToInt64 got value not equal 3 bytes %+v", value)
-		return 0
-	}
-	return int(uint(value[2]) | uint(value[1])<<8 | uint(value[0])<<16)
+// signedInt func
+// big endian two's complement of 1 to 8 bytes
+func signedInt(value []byte) int64 {
+	shift := uint(64 - 8*len(value))
+	return int64(unsignedInt(value)<<shift) >> shift
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// decoderCase type
+// payload decoding expectation shared by byte parser tests, offset is -1 when no error is expected
+type decoderCase struct {
+	name    string
+	payload string
+	want    map[string]interface{}
+	offset  int
+}
+
+// checkDecoderCases func
+// decoded values are compared in their json form with float tolerance, same as spec samples
+func checkDecoderCases(t *testing.T, decode func(string) (interface{}, error), cases []decoderCase) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			decoded, err := decode(c.payload)
+			if c.offset < 0 {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			} else {
+				failed, ok := err.(*decodeError)
+				if !ok {
+					t.Fatalf("expected decodeError at offset %d, got %v", c.offset, err)
+				}
+				if failed.Offset != c.offset {
+					t.Fatalf("expected error at offset %d, got %v", c.offset, failed)
+				}
+			}
+			got, want := normalizeJSON(decoded), normalizeJSON(c.want)
+			if !sameValue(got, want) {
+				t.Fatalf("got %v, expected %v", got, want)
+			}
+		})
+	}
+}
+
+// checkDecodeOffset func
+// fuzz invariant of byte parsers: no panic, and failure offset within the payload
+func checkDecodeOffset(t *testing.T, decode func(string) (interface{}, error), data []byte) {
+	_, err := decode(hex.EncodeToString(data))
+	if err == nil {
+		return
+	}
+	failed, ok := err.(*decodeError)
+	if !ok {
+		t.Fatalf("hex payload failed without offset: %v", err)
+	}
+	if failed.Offset < 0 || failed.Offset > len(data) {
+		t.Fatalf("offset %d out of %d bytes payload", failed.Offset, len(data))
+	}
+}
+
+func position(lat float64, lon float64, alt interface{}, source string) map[string]interface{} {
+	p := map[string]interface{}{"lat": lat, "lon": lon, "source": source}
+	if alt != nil {
+		p["alt"] = alt
+	}
+	return p
+}
+
+func TestDecodeTNGps(t *testing.T) {
+	checkDecoderCases(t, DecodeTNGps, []decoderCase{
+		{"battery", "00FF0172", map[string]interface{}{"battery": 3.7}, -1},
+		{"battery negative", "00FFFF9C", map[string]interface{}{"battery": -1.0}, -1},
+		{"gps", "01880AE9D100B6AB0001F4", map[string]interface{}{"gps": position(71.5217, 4.6763, 5.0, "gps")}, -1},
+		{"gps negative", "0188FFFFFFF5162FFFFF9C", map[string]interface{}{"gps": position(-0.0001, -71.5217, -1.0, "gps")}, -1},
+		{"gps status", "020001", map[string]interface{}{"gps_status": true}, -1},
+		{"gps hp", "03891DCD6500FF676980", map[string]interface{}{"gps_hp": position(50.0, -1.0, nil, "gps_hp")}, -1},
+		{"impact magnitude", "05020064", map[string]interface{}{"impact_magnitude": 1.0}, -1},
+		{"break in", "060000", map[string]interface{}{"break_in": false}, -1},
+		{"accelerometer", "07710064FF9C0000", map[string]interface{}{"accelerometer": map[string]interface{}{"x": 1.0, "y": -1.0, "z": 0.0}}, -1},
+		{"mcu temperature", "0B6700FA", map[string]interface{}{"mcu_temperature": 25.0}, -1},
+		{"mcu temperature negative", "0B67FF38", map[string]interface{}{"mcu_temperature": -20.0}, -1},
+		{"impact alarm", "0C0001", map[string]interface{}{"impact_alarm": true}, -1},
+		{"several channels", "0200010B6700FA", map[string]interface{}{"gps_status": true, "mcu_temperature": 25.0}, -1},
+		{"empty", "", map[string]interface{}{}, -1},
+		{"truncated header", "01", map[string]interface{}{}, 0},
+		{"truncated header after channel", "0200010B", map[string]interface{}{"gps_status": true}, 3},
+		{"truncated value", "01880AE9D1", map[string]interface{}{}, 2},
+		{"truncated value after channel", "0200010B6700", map[string]interface{}{"gps_status": true}, 5},
+		{"unknown channel", "0400", map[string]interface{}{}, 0},
+		{"wrong data type", "01890AE9D100B6AB0001F4", map[string]interface{}{}, 1},
+	})
+}
+
+func TestDecodeTNGpsNotHex(t *testing.T) {
+	if _, err := DecodeTNGps("zz"); err == nil {
+		t.Fatal("error expected for non hex payload")
+	}
+}
+
+func FuzzDecodeTNGps(f *testing.F) {
+	for _, seed := range []string{
+		"00FF0172", "01880AE9D100B6AB0001F4", "020001", "03891DCD6500FF676980", "05020064",
+		"060000", "07710064FF9C0000", "0B6700FA", "0C0001", "0200010B6700FA",
+		"", "01", "01880AE9D1", "0400", "01890AE9D100B6AB0001F4",
+	} {
+		data, _ := hex.DecodeString(seed)
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecodeOffset(t, DecodeTNGps, data)
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// downlink fallback policies for devices with unknown appx
+const (
+	fallbackAny       = "any"
+	fallbackBroadcast = "broadcast"
+	fallbackDrop      = "drop"
+)
+
+// status messages waiting for mqtt, more are dropped rather than blocking the caller
+const downlinkStatusBacklog = 1000
+
+var (
+	errNoConnection = errors.New("no appx connection to route downlink to")
+	errDropped      = errors.New("downlink to device with unknown appx dropped by fallback policy")
+)
+
+// DownlinkError type
+// downlink refused before reaching TCIO, reported back to submitter as is
+type DownlinkError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *DownlinkError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var affinity = newAffinityTable()
+
+// affinityTable type
+// DevEui to appxid the device is talking through, learned from uplinks, static config mapping wins
+type affinityTable struct {
+	learned map[string]string
+	static  map[string]string
+	mu      sync.RWMutex
+}
+
+func newAffinityTable() *affinityTable {
+	return &affinityTable{
+		learned: make(map[string]string),
+		static:  make(map[string]string),
+	}
+}
+
+// Learn func
+// true when device route is new or changed
+func (a *affinityTable) Learn(deveui string, appxID string) bool {
+	if deveui == "" || appxID == "" {
+		return false
+	}
+	a.mu.RLock()
+	known := a.learned[deveui]
+	a.mu.RUnlock()
+	if known == appxID {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if known != "" {
+		logger.WithFields(log.Fields{"DevEui": deveui, "was": known, "now": appxID}).Infoln("Device moved to another appx")
+	}
+	a.learned[deveui] = appxID
+	affinityDevices.Set(float64(len(a.learned)))
+	return true
+}
+
+// SetStatic func
+func (a *affinityTable) SetStatic(static map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.static = make(map[string]string, len(static))
+	for deveui, appxID := range static {
+		a.static[deveui] = appxID
+	}
+}
+
+// Lookup func
+func (a *affinityTable) Lookup(deveui string) (appxID string, route string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if appxID, ok := a.static[deveui]; ok {
+		return appxID, "static"
+	}
+	if appxID, ok := a.learned[deveui]; ok {
+		return appxID, "learned"
+	}
+	return "", "fallback"
+}
+
+// Get func
+func (p *connPool) Get(appxID string) *connection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.connections {
+		if conn.appxID == appxID && conn.alive {
+			return conn
+		}
+	}
+	return nil
+}
+
+// Alive func
+func (p *connPool) Alive() []*connection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var alive []*connection
+	for conn := range p.connections {
+		if conn.alive {
+			alive = append(alive, conn)
+		}
+	}
+	return alive
+}
+
+// SubmitDownlink func
+// single way in for downlinks coming from mqtt and api, MsgId is assigned if missing,
+// downlinks which can't be written to appx right now go to outbox
+func (ctx *Context) SubmitDownlink(msg *TracknetDnDfSpecialMsg) error {
+	msg.MsgType = "dndf"
+
+	if msg.Command != nil {
+		fport, payload, err := ctx.EncodeCommand(msg.DevEui, msg.Command)
+		if err != nil {
+			ctx.downlinkRejected(msg, err.(*DownlinkError))
+			return err
+		}
+		msg.FPort, msg.FRMPayload, msg.Command = fport, strings.ToUpper(payload), nil
+	}
+	if err := ValidateDownlink(msg); err != nil {
+		ctx.downlinkRejected(msg, err)
+		return err
+	}
+	if msg.MsgID == 0 {
+		msg.MsgID = nextMsgID()
+	}
+
+	ctx.downlinkStatusChanged(ledger.Submit(*msg))
+	err := pool.SendDownlink(*msg, ctx.Downlinks.Fallback)
+	if err == nil {
+		return nil
+	}
+	if err == errDropped {
+		if entry, ok := ledger.Fail(msg.MsgID, err.Error()); ok {
+			ctx.downlinkStatusChanged(entry)
+		}
+		return err
+	}
+
+	// the sender is gone already, outbox is the only chance for the downlink
+	logger.WithFields(log.Fields{"DevEui": msg.DevEui, "MsgId": msg.MsgID}).Warnf("Downlink outboxed: %+v", err)
+	ctx.outbox.Push(*msg, err.Error())
+	if entry, ok := ledger.Outbox(msg.MsgID, err.Error()); ok {
+		ctx.downlinkStatusChanged(entry)
+	}
+	return nil
+}
+
+// downlinkStatusChanged func
+// accounts new downlink states and lets submitters know via mqtt status topic if configured
+func (ctx *Context) downlinkStatusChanged(entries ...DownlinkEntry) {
+	var messages []mqttMessage
+	for _, entry := range entries {
+		downlinkStatus.WithLabelValues(entry.Status).Inc()
+		logger.WithFields(log.Fields{"DevEui": entry.DevEui, "MsgId": entry.MsgID}).Debugf("Downlink %s %s", entry.Status, entry.Error)
+
+		if ctx.Downlinks.StatusTopic == "" || ctx.mqttClient == nil {
+			continue
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			logger.Errorf("Can't convert downlink status to json string: %+v", err)
+			continue
+		}
+		topic := mqttTopic(ctx.Downlinks.StatusTopic, ctx.Mqtt.UpTopic, map[string]interface{}{"DevEui": entry.DevEui, "msgtype": entry.Status})
+		messages = append(messages, mqttMessage{topic, ctx.Mqtt.DnQoS, false, data, 0})
+	}
+
+	ctx.publishStatus(messages...)
+}
+
+// downlinkRejected func
+// invalid downlinks never get to ledger, submitter learns about them from status topic
+func (ctx *Context) downlinkRejected(msg *TracknetDnDfSpecialMsg, derr *DownlinkError) {
+	downlinkStatus.WithLabelValues(downlinkInvalid).Inc()
+	logger.WithFields(log.Fields{"DevEui": msg.DevEui, "MsgId": msg.MsgID, "field": derr.Field}).Warnf("Downlink rejected: %s", derr.Message)
+
+	if ctx.Downlinks.StatusTopic == "" || ctx.mqttClient == nil {
+		return
+	}
+	data, err := json.Marshal(struct {
+		MsgID  int64          `json:"MsgId,omitempty"`
+		DevEui string         `json:"DevEui"`
+		Status string         `json:"status"`
+		Error  *DownlinkError `json:"error"`
+	}{msg.MsgID, msg.DevEui, downlinkInvalid, derr})
+	if err != nil {
+		logger.Errorf("Can't convert downlink error to json string: %+v", err)
+		return
+	}
+	topic := mqttTopic(ctx.Downlinks.StatusTopic, ctx.Mqtt.UpTopic, map[string]interface{}{"DevEui": msg.DevEui, "msgtype": downlinkInvalid})
+	ctx.publishStatus(mqttMessage{topic, ctx.Mqtt.DnQoS, false, data, 0})
+}
+
+// publishStatus func
+// never blocks, downlinks come in from paho handler and publish tokens can't complete until it returns
+func (ctx *Context) publishStatus(messages ...mqttMessage) {
+	for _, msg := range messages {
+		select {
+		case ctx.statusOut <- msg:
+		default:
+			logger.Warnf("Downlink status backlog is full, dropping status to %s", msg.Topic)
+			mqttPublishFailed.Inc()
+		}
+	}
+}
+
+// PublishStatuses func
+// publishes downlink statuses in the order they happened, waiting for tokens is fine here
+func (ctx *Context) PublishStatuses() {
+	for {
+		select {
+		case <-shutdown:
+			return
+		case msg := <-ctx.statusOut:
+			messages := []mqttMessage{msg}
+			for len(ctx.statusOut) > 0 && len(messages) < downlinkStatusBacklog {
+				messages = append(messages, <-ctx.statusOut)
+			}
+			ctx.mqttPublishAll(messages)
+		}
+	}
+}
+
+// EncodeCommand func
+// builds downlink out of structured command with the encoder of device type from inventory, resolved through fports
+func (ctx *Context) EncodeCommand(deveui string, command map[string]interface{}) (uint8, string, error) {
+	devType, ok := ctx.Inventory[deveui]
+	if !ok {
+		return 0, "", &DownlinkError{"unknown_device", "DevEui", "device " + deveui + " is not listed in inventory, can't encode command"}
+	}
+	decoder, ok := ctx.Registry().Encoder(devType)
+	if !ok {
+		return 0, "", &DownlinkError{"no_encoder", "command", "no encoder for device type " + devType}
+	}
+
+	fport, payload, err := decoder.Encode(command)
+	if err != nil {
+		downlinksEncoded.WithLabelValues(devType, "failed").Inc()
+		return 0, "", &DownlinkError{"encode_failed", "command", err.Error()}
+	}
+	if _, err := hex.DecodeString(payload); err != nil {
+		downlinksEncoded.WithLabelValues(devType, "failed").Inc()
+		return 0, "", &DownlinkError{"encode_failed", "command", "encoder of " + devType + " returned non hex payload"}
+	}
+	downlinksEncoded.WithLabelValues(devType, "success").Inc()
+	return fport, payload, nil
+}
+
+// SendDownlink func
+// writes dndf to the appx owning the device, unknown devices are handled according to fallback policy
+func (p *connPool) SendDownlink(msg TracknetDnDfSpecialMsg, fallback string) error {
+	appxID, route := affinity.Lookup(msg.DevEui)
+
+	var targets []*connection
+	if route != "fallback" {
+		if conn := p.Get(appxID); conn != nil {
+			targets = append(targets, conn)
+		} else {
+			logger.WithFields(log.Fields{"DevEui": msg.DevEui, "appx_id": appxID}).Warnln("Appx owning the device is not connected")
+		}
+	} else {
+		switch fallback {
+		case fallbackDrop:
+			return errDropped
+		case fallbackBroadcast:
+			// appxs not owning the device are answering with bad_dndf, that is fine
+			targets = p.Alive()
+		default:
+			if alive := p.Alive(); len(alive) > 0 {
+				targets = alive[:1]
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		return errNoConnection
+	}
+	ledger.Targets(msg, len(targets))
+
+	var err error
+	sent := 0
+	for _, conn := range targets {
+		if werr := conn.WriteJSON(msg); werr != nil {
+			logger.WithFields(log.Fields{"DevEui": msg.DevEui, "appx_id": conn.appxID}).Errorf("Fail to send dn message %+v", werr)
+			err = werr
+			continue
+		}
+		sent++
+		messagesForwardedToTcio.WithLabelValues(conn.appxID, conn.appxURI).Inc()
+	}
+	if sent == 0 {
+		return err
+	}
+	downlinksRouted.WithLabelValues(route).Inc()
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// encodingDecoder func
+// decoder with encoder telling which decoder type encoded the command
+func encodingDecoder(decoderType string, fport uint8) Decoder {
+	return Decoder{
+		Type:   decoderType,
+		Decode: func(string) (interface{}, error) { return nil, nil },
+		Encode: func(command map[string]interface{}) (uint8, string, error) {
+			return fport, fmt.Sprintf("%02X", len(decoderType)), nil
+		},
+	}
+}
+
+func TestEncodeCommandRouted(t *testing.T) {
+	plain := Decoder{Type: "acme_gps", Decode: func(string) (interface{}, error) { return nil, nil }}
+	ctx := &Context{Inventory: map[string]string{
+		"01": "acme",      // routed, encoder on "*" decoder, no decoder of its own name
+		"02": "acme_port", // routed, encoder on FPort decoder only
+		"03": "acme_own",  // routed, encoder on decoder of its own name
+		"04": "acme_cfg",  // not routed, decoder of its own name
+		"05": "acme_none", // routed, no encoder at all
+	}}
+	ctx.registry.Store(&decoderRegistry{
+		decoders: map[string]Decoder{
+			"acme_gps": plain,
+			"acme_cfg": encodingDecoder("acme_cfg", 10),
+			"acme_own": encodingDecoder("acme_own", 11),
+			"acme_alt": encodingDecoder("acme_alt", 12),
+		},
+		routes: map[string]fportRoutes{
+			"acme":      {ports: map[uint8]string{1: "acme_gps"}, fallback: "acme_cfg"},
+			"acme_port": {ports: map[uint8]string{1: "acme_gps", 7: "acme_alt"}},
+			"acme_own":  {ports: map[uint8]string{1: "acme_gps", 7: "acme_alt"}},
+			"acme_none": {ports: map[uint8]string{1: "acme_gps"}, fallback: ""},
+		},
+	})
+
+	for _, c := range []struct {
+		name   string
+		deveui string
+		fport  uint8
+		code   string
+	}{
+		{"fallback decoder", "01", 10, ""},
+		{"port decoder", "02", 12, ""},
+		{"own name decoder", "03", 11, ""},
+		{"not routed", "04", 10, ""},
+		{"no encoder", "05", 0, "no_encoder"},
+		{"not in inventory", "06", 0, "unknown_device"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fport, _, err := ctx.EncodeCommand(c.deveui, map[string]interface{}{"interval": 60})
+			if c.code != "" {
+				if failed, ok := err.(*DownlinkError); !ok || failed.Code != c.code {
+					t.Fatalf("expected %s, got %v", c.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if fport != c.fport {
+				t.Fatalf("encoded for FPort %d, expected %d", fport, c.fport)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// elasticDocType is the mapping type used for every indexed event
+const elasticDocType = "logs"
+
+// defaultElasticTemplate maps the fields we are searching and plotting on, everything else is left to dynamic mapping.
+// Positions are found at any depth of payload (path_match * spans dots), or as the payload itself
+const defaultElasticTemplate = `{
+	"order": 0,
+	"mappings": {
+		"logs": {
+			"dynamic_templates": [
+				{"positions": {"path_match": "payload.*.location", "mapping": {"type": "geo_point"}}},
+				{"payload_position": {"path_match": "payload.location", "mapping": {"type": "geo_point"}}}
+			],
+			"properties": {
+				"ArrTime": {"type": "date"},
+				"DevEui":  {"type": "keyword"},
+				"msgtype": {"type": "keyword"}
+			}
+		}
+	}
+}`
+
+// InstallElasticTemplate func
+// puts the index template covering ctx.Elastic.Index, the body is taken from ctx.Elastic.Template if configured
+func (ctx *Context) InstallElasticTemplate() {
+	var (
+		raw      = []byte(defaultElasticTemplate)
+		template map[string]interface{}
+		err      error
+	)
+
+	if ctx.Elastic.Template != "" {
+		raw, err = ioutil.ReadFile(ctx.Elastic.Template)
+		if err != nil {
+			logger.WithFields(log.Fields{"template": ctx.Elastic.Template}).Fatalf("Can't load elastic template %+v", err)
+		}
+	}
+
+	if err = json.Unmarshal(raw, &template); err != nil {
+		logger.WithFields(log.Fields{"template": ctx.Elastic.Template}).Fatalf("Can't parse elastic template %+v", err)
+	}
+
+	// let the template file omit the index pattern, we know it better
+	if _, ok := template["template"]; !ok {
+		template["template"] = elasticIndexPattern(ctx.Elastic.Index)
+	}
+
+	_, err = ctx.esClient.IndexPutTemplate(ctx.AppName).BodyJson(template).Do(context.Background())
+	if err != nil {
+		logger.WithFields(log.Fields{"name": ctx.AppName, "pattern": template["template"]}).Fatalf("Can't install elastic template %+v", err)
+	}
+	logger.Infof("Elastic template %s installed for %v", ctx.AppName, template["template"])
+}
+
+// elasticIndexPattern func
+// ctx.Elastic.Index is a time layout, so the pattern is the constant prefix of it followed by wildcard,
+// sample dates differ in the first digit of every field, so the prefix has no digits of time in it
+func elasticIndexPattern(layout string) string {
+	a := time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC).Format(layout)
+	b := time.Date(2012, 12, 22, 13, 14, 15, 0, time.UTC).Format(layout)
+
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	if i == len(a) && i == len(b) {
+		// there is no time part in index name at all
+		return a
+	}
+	return a[:i] + "*"
+}
+
+// elasticDoc type
+type elasticDoc struct {
+	ID    string
+	Index string
+	Doc   interface{}
+}
+
+// elasticUndatedIndex func
+// for events without time of their own, within index pattern so the template applies
+func elasticUndatedIndex(layout string) string {
+	pattern := elasticIndexPattern(layout)
+	if !strings.HasSuffix(pattern, "*") {
+		return pattern
+	}
+	return strings.TrimSuffix(pattern, "*") + "undated"
+}
+
+// elasticDocument func
+// the index is picked by event time rather than by now, so replayed events land on their original documents,
+// ArrTime synthesized on arrival would differ on replay, router arrival times or undated index are taken then
+func (ctx *Context) elasticDocument(event interface{}) elasticDoc {
+	doc := elasticDoc{Index: time.Now().Format(ctx.Elastic.Index), Doc: event}
+
+	record, ok := event.(map[string]interface{})
+	if !ok {
+		return doc
+	}
+	if id, ok := record["id"].(string); ok {
+		doc.ID = id
+	}
+	if synth, _ := record["SinthTime"].(bool); synth {
+		doc.Index = elasticUndatedIndex(ctx.Elastic.Index)
+		if t, ok := upinfoArrTime(record); ok {
+			doc.Index = t.Format(ctx.Elastic.Index)
+		}
+	} else if t, ok := recordTime(record["ArrTime"]); ok {
+		doc.Index = t.Format(ctx.Elastic.Index)
+	}
+
+	doc.Doc = encodeRecordPositions(record, elasticPosition)
+	return doc
+}
+
+// upinfoArrTime func
+// earliest arrival time reported by routers, the same on every replay of the event
+func upinfoArrTime(record map[string]interface{}) (time.Time, bool) {
+	var earliest time.Time
+	infos, _ := record["upinfo"].([]interface{})
+	for _, each := range infos {
+		info, _ := each.(map[string]interface{})
+		if t, ok := recordTime(info["ArrTime"]); ok && (earliest.IsZero() || t.Before(earliest)) {
+			earliest = t
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// recordTime func
+// Time fields come out of StructToMap as RFC3339 strings, unset ones as zero time
+func recordTime(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil || t.Unix() <= 0 {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// elasticBulkResult func
+// accounts every item of bulk response, returns documents worth another attempt
+func (ctx *Context) elasticBulkResult(docs []elasticDoc, resp *elastic.BulkResponse, retry bool) []elasticDoc {
+	var again []elasticDoc
+
+	for i, item := range resp.Items {
+		if i >= len(docs) {
+			logger.Errorf("ElasticSearch responded with %v items on %v documents", len(resp.Items), len(docs))
+			break
+		}
+		for _, result := range item {
+			var errType, reason string
+			if result.Error != nil {
+				errType, reason = result.Error.Type, result.Error.Reason
+			}
+			elasticBulkItems.WithLabelValues(strconv.Itoa(result.Status), errType).Inc()
+
+			switch {
+			case result.Status >= 200 && result.Status <= 299:
+				messagesStoredInElastic.Inc()
+			case retry && elasticRetryable(result.Status):
+				again = append(again, docs[i])
+			default:
+				elasticInsertFailed.Inc()
+				ctx.esFailures.Write(docs[i], result.Status, errType, reason)
+			}
+		}
+	}
+	return again
+}
+
+// elasticRetryable func
+// statuses meaning "not now" rather than "never"
+func elasticRetryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// elasticRequestRetryable func
+// whole bulk request failed, overloaded node answers with retryable status, no answer at all is worth another try too
+func elasticRequestRetryable(err error) bool {
+	if failed, ok := err.(*elastic.Error); ok {
+		return elasticRetryable(failed.Status)
+	}
+	return true
+}
+
+// failureLog type
+// keeps documents the backend refused for good, one json per line
+type failureLog struct {
+	path string
+	out  *os.File
+	mu   sync.Mutex
+}
+
+type failureLogEntry struct {
+	Time      time.Time   `json:"time"`
+	Index     string      `json:"index"`
+	ID        string      `json:"id"`
+	Status    int         `json:"status"`
+	ErrorType string      `json:"error_type"`
+	Reason    string      `json:"reason"`
+	Document  interface{} `json:"doc"`
+}
+
+func newFailureLog(path string) *failureLog {
+	f := failureLog{path: path}
+	if path == "" {
+		return &f
+	}
+
+	handle, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		logger.WithFields(log.Fields{"failure_log": path}).Fatalf("Can't open failure log %+v", err)
+	}
+	f.out = handle
+	return &f
+}
+
+// Write func
+// with no file configured failed documents end up in the main log
+func (f *failureLog) Write(doc elasticDoc, status int, errType string, reason string) {
+	entry := failureLogEntry{time.Now(), doc.Index, doc.ID, status, errType, reason, doc.Doc}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Errorf("Can't marshal failed document %+v: %+v", entry, err)
+		return
+	}
+
+	if f.out == nil {
+		logger.WithFields(log.Fields{"index": doc.Index, "id": doc.ID, "status": status, "error_type": errType}).Errorf("Document dropped: %s", string(line))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.out.Write(append(line, '\n')); err != nil {
+		logger.WithFields(log.Fields{"failure_log": f.path}).Errorf("Can't write failure log %+v, document %s", err, string(line))
+	}
+}
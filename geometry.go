@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+)
+
+// Position type
+// backend neutral location emitted by decoders, every sink encodes it natively on the way out
+type Position struct {
+	Lat      float64  `json:"lat"`
+	Lon      float64  `json:"lon"`
+	Alt      *float64 `json:"alt,omitempty"`      // meters
+	Accuracy *float64 `json:"accuracy,omitempty"` // meters
+	Source   string   `json:"source,omitempty"`   // gps, gps_hp, cayenne...
+}
+
+// positionEncoder converts position into backend specific representation
+type positionEncoder func(p Position) interface{}
+
+// reqlPosition func
+// ReQL geometry can't carry anything but the point, so the rest of position lives next to it
+func reqlPosition(p Position) interface{} {
+	encoded := positionExtras(p)
+	encoded["location"] = map[string]interface{}{
+		"$reql_type$": "GEOMETRY",
+		"type":        "Point",
+		"coordinates": []float64{p.Lon, p.Lat},
+	}
+	return encoded
+}
+
+// elasticPosition func
+// location goes as geo_point object, see dynamic templates in defaultElasticTemplate
+func elasticPosition(p Position) interface{} {
+	encoded := positionExtras(p)
+	encoded["location"] = map[string]float64{"lat": p.Lat, "lon": p.Lon}
+	return encoded
+}
+
+// geoJSONPosition func
+// GeoJSON Feature for mqtt and webhook consumers, altitude is the optional third coordinate
+func geoJSONPosition(p Position) interface{} {
+	coordinates := []float64{p.Lon, p.Lat}
+	if p.Alt != nil {
+		coordinates = append(coordinates, *p.Alt)
+	}
+	properties := positionExtras(p)
+	delete(properties, "alt")
+	return map[string]interface{}{
+		"type": "Feature",
+		"geometry": map[string]interface{}{
+			"type":        "Point",
+			"coordinates": coordinates,
+		},
+		"properties": properties,
+	}
+}
+
+// wkbPosition func
+// hex encoded ISO WKB point (Point Z if altitude is known) for SQL backends
+func wkbPosition(p Position) interface{} {
+	return hex.EncodeToString(p.WKB())
+}
+
+// WKB func
+// little endian ISO well-known binary of the point
+func (p Position) WKB() []byte {
+	var (
+		buf    bytes.Buffer
+		wkbTyp = uint32(1) // Point
+	)
+	if p.Alt != nil {
+		wkbTyp = 1001 // Point Z
+	}
+
+	buf.WriteByte(1)
+	binary.Write(&buf, binary.LittleEndian, wkbTyp)
+	binary.Write(&buf, binary.LittleEndian, math.Float64bits(p.Lon))
+	binary.Write(&buf, binary.LittleEndian, math.Float64bits(p.Lat))
+	if p.Alt != nil {
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(*p.Alt))
+	}
+	return buf.Bytes()
+}
+
+func positionExtras(p Position) map[string]interface{} {
+	extras := map[string]interface{}{}
+	if p.Alt != nil {
+		extras["alt"] = *p.Alt
+	}
+	if p.Accuracy != nil {
+		extras["accuracy"] = *p.Accuracy
+	}
+	if p.Source != "" {
+		extras["source"] = p.Source
+	}
+	return extras
+}
+
+// encodeRecordPositions func
+// returns copy of the stored record with positions in payload encoded, the record itself is shared by all sinks
+func encodeRecordPositions(event interface{}, encode positionEncoder) interface{} {
+	record, ok := event.(map[string]interface{})
+	if !ok {
+		return event
+	}
+	payload, ok := record["payload"]
+	if !ok {
+		return event
+	}
+
+	encoded := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		encoded[k] = v
+	}
+	encoded["payload"] = encodePositions(payload, encode)
+	return encoded
+}
+
+// encodePositions func
+// walks decoded payload and replaces every position found
+func encodePositions(value interface{}, encode positionEncoder) interface{} {
+	switch v := value.(type) {
+	case *interface{}:
+		return encodePositions(*v, encode)
+	case Position:
+		return encode(v)
+	case *Position:
+		return encode(*v)
+	case map[string]interface{}:
+		if p, ok := legacyPosition(v); ok {
+			return encode(p)
+		}
+		encoded := make(map[string]interface{}, len(v))
+		for key, each := range v {
+			encoded[key] = encodePositions(each, encode)
+		}
+		return encoded
+	case []interface{}:
+		encoded := make([]interface{}, len(v))
+		for i, each := range v {
+			encoded[i] = encodePositions(each, encode)
+		}
+		return encoded
+	}
+	return value
+}
+
+// legacyPosition func
+// plugins built before Position type emit ReQL geometry points, take them as well
+func legacyPosition(v map[string]interface{}) (Position, bool) {
+	if v["$reql_type$"] != "GEOMETRY" || v["type"] != "Point" {
+		return Position{}, false
+	}
+
+	var coordinates []float64
+	switch c := v["coordinates"].(type) {
+	case []float64:
+		coordinates = c
+	case []interface{}:
+		for _, each := range c {
+			f, ok := each.(float64)
+			if !ok {
+				return Position{}, false
+			}
+			coordinates = append(coordinates, f)
+		}
+	}
+	if len(coordinates) < 2 {
+		return Position{}, false
+	}
+	return Position{Lat: coordinates[1], Lon: coordinates[0]}, true
+}
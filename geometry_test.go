@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestWKBPosition(t *testing.T) {
+	alt := 3.0
+	for _, c := range []struct {
+		name string
+		p    Position
+		want string
+	}{
+		{"point", Position{Lat: 2, Lon: 1}, "0101000000000000000000f03f0000000000000040"},
+		{"point z", Position{Lat: 2, Lon: 1, Alt: &alt}, "01e9030000000000000000f03f00000000000000400000000000000840"},
+		{"negative", Position{Lat: -0.5, Lon: -180}, "010100000000000000008066c0000000000000e0bf"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := wkbPosition(c.p); got != c.want {
+				t.Fatalf("got %v, expected %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// GroupTarget type
+// devices addressed by a group downlink, the conditions are ANDed
+type GroupTarget struct {
+	Tag    string `json:"tag,omitempty"`    // from inventory tags
+	Type   string `json:"type,omitempty"`   // device type from inventory
+	DevEui string `json:"DevEui,omitempty"` // regex, same as Filters.DevEui
+}
+
+// GroupStatus type
+// aggregated state of the per device jobs of a group
+type GroupStatus struct {
+	ID      int64          `json:"id"`
+	Devices int            `json:"devices"`
+	Status  map[string]int `json:"status"` // job state, or downlink state once submitted
+	Done    bool           `json:"done"`
+	Jobs    []DownlinkJob  `json:"jobs"`
+}
+
+// ExpandGroup func
+// devices known from inventory, tags and uplinks seen, matching the target, sorted
+func (ctx *Context) ExpandGroup(target GroupTarget) ([]string, error) {
+	if target.Tag == "" && target.Type == "" && target.DevEui == "" {
+		return nil, fmt.Errorf("group target needs at least one of tag, type or DevEui")
+	}
+	var expr *regexp.Regexp
+	if target.DevEui != "" {
+		var err error
+		if expr, err = regexp.Compile(target.DevEui); err != nil {
+			return nil, fmt.Errorf("bad DevEui regex: %v", err)
+		}
+	}
+	if _, ok := ctx.Tags[target.Tag]; target.Tag != "" && !ok {
+		return nil, fmt.Errorf("unknown tag %s", target.Tag)
+	}
+
+	known := make(map[string]bool)
+	for deveui := range ctx.Inventory {
+		known[deveui] = true
+	}
+	for _, members := range ctx.Tags {
+		for _, deveui := range members {
+			known[deveui] = true
+		}
+	}
+	for _, deveui := range affinity.Devices() {
+		known[deveui] = true
+	}
+
+	var devices []string
+	for deveui := range known {
+		if target.Tag != "" && !stringInSlice(deveui, ctx.Tags[target.Tag]) {
+			continue
+		}
+		if target.Type != "" && ctx.Inventory[deveui] != target.Type {
+			continue
+		}
+		if expr != nil && !expr.MatchString(deveui) {
+			continue
+		}
+		devices = append(devices, deveui)
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// AddGroup func
+// jobs already carrying an error are recorded as failed right away, so they show up in group status,
+// they never went to the device queue, so the policy doesn't touch jobs waiting for the device
+func (s *downlinkScheduler) AddGroup(jobs []DownlinkJob, policy string) int64 {
+	if policy == "" {
+		policy = s.policy
+	}
+	group := nextMsgID()
+
+	s.mu.Lock()
+	for _, job := range jobs {
+		job.Group = group
+		if job.Error != "" {
+			failed := job
+			failed.ID = nextMsgID()
+			failed.Created = time.Now()
+			s.finish(&failed, jobFailed, job.Error)
+			s.jobs[failed.ID] = &failed
+			downlinkJobs.WithLabelValues(jobFailed).Inc()
+			continue
+		}
+		s.add(job, policy)
+	}
+	s.save()
+	s.mu.Unlock()
+
+	s.Wake()
+	return group
+}
+
+// Group func
+func (s *downlinkScheduler) Group(id int64) (GroupStatus, bool) {
+	status := GroupStatus{ID: id, Status: make(map[string]int), Done: true}
+	for _, job := range s.List("") {
+		if job.Group != id {
+			continue
+		}
+		state := job.Status
+		switch job.Status {
+		case jobScheduled:
+			status.Done = false
+		case jobSubmitted:
+			if entry, ok := ledger.Get(job.MsgID); ok {
+				state = entry.Status
+				status.Done = status.Done && entry.Done()
+			}
+		}
+		status.Status[state]++
+		status.Jobs = append(status.Jobs, job)
+	}
+	status.Devices = len(status.Jobs)
+	return status, status.Devices > 0
+}
+
+// Devices func
+// devices with learned affinity
+func (a *affinityTable) Devices() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	devices := make([]string, 0, len(a.learned))
+	for deveui := range a.learned {
+		devices = append(devices, deveui)
+	}
+	return devices
+}
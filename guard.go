@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// decoder failure reasons
+const (
+	decodeFailedError   = "error"
+	decodeFailedPanic   = "panic"
+	decodeFailedTimeout = "timeout"
+)
+
+// decodeResult type
+type decodeResult struct {
+	payload interface{}
+	err     error
+	reason  string
+}
+
+// guardedDecode func
+// decoder runs in its own goroutine, panics are recovered and result is waited for until deadline,
+// go code can't be killed so a hung decoder goroutine is left behind and accounted
+func guardedDecode(decoder Decoder, in UplinkInput, deadline time.Duration) (interface{}, string, error) {
+	done := make(chan decodeResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.WithFields(log.Fields{"type": decoder.Type, "DevEui": in.DevEui}).Errorf("Decoder panic: %v\n%s", r, debug.Stack())
+				done <- decodeResult{nil, fmt.Errorf("decoder panic: %v", r), decodeFailedPanic}
+			}
+		}()
+		payload, err := decoder.DecodeUplink(in)
+		if err != nil {
+			done <- decodeResult{payload, err, decodeFailedError}
+			return
+		}
+		done <- decodeResult{payload, nil, ""}
+	}()
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.payload, result.reason, result.err
+	case <-timer.C:
+		decodersHung.Inc()
+		go func() {
+			<-done
+			decodersHung.Dec()
+		}()
+		return nil, decodeFailedTimeout, fmt.Errorf("decoder didn't finish in %v", deadline)
+	}
+}
+
+// quarantineTable type
+// decoder types and devices failing in a row are not decoded for a cool-down period
+type quarantineTable struct {
+	after    int
+	cooldown time.Duration
+	devices  map[string]int             // consecutive failures by device
+	types    map[string]map[string]bool // devices failed in a row by decoder type, any success clears it
+	until    map[string]time.Time       // quarantined keys
+	mu       sync.Mutex
+}
+
+func newQuarantineTable(after int, cooldown time.Duration) *quarantineTable {
+	return &quarantineTable{
+		after:    after,
+		cooldown: cooldown,
+		devices:  make(map[string]int),
+		types:    make(map[string]map[string]bool),
+		until:    make(map[string]time.Time),
+	}
+}
+
+func quarantineDecoderKey(devType string) string { return "type:" + devType }
+func quarantineDeviceKey(deveui string) string   { return "device:" + deveui }
+
+// Check func
+// error tells why the uplink is not going to be decoded
+func (q *quarantineTable) Check(devType string, deveui string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, key := range []string{quarantineDecoderKey(devType), quarantineDeviceKey(deveui)} {
+		until, ok := q.until[key]
+		if !ok {
+			continue
+		}
+		if now.Before(until) {
+			return fmt.Errorf("%s quarantined until %s", key, until.Format(time.RFC3339))
+		}
+		logger.WithFields(log.Fields{"key": key}).Infoln("Decoding quarantine is over")
+		delete(q.until, key)
+		q.account()
+	}
+	return nil
+}
+
+// Success func
+func (q *quarantineTable) Success(devType string, deveui string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.types, devType)
+	delete(q.devices, deveui)
+}
+
+// Failure func
+// a device failing alone gets quarantined, the decoder only when distinct devices fail in a row,
+// so one broken device can't take the decoder down for everybody
+func (q *quarantineTable) Failure(devType string, deveui string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.devices[deveui]++
+	failing, ok := q.types[devType]
+	if !ok {
+		failing = make(map[string]bool)
+		q.types[devType] = failing
+	}
+	failing[deveui] = true
+	if q.after <= 0 {
+		return
+	}
+
+	if q.devices[deveui] >= q.after {
+		q.quarantine(quarantineDeviceKey(deveui), log.Fields{"failures": q.devices[deveui]})
+		delete(q.devices, deveui)
+	}
+	if len(failing) >= q.after {
+		q.quarantine(quarantineDecoderKey(devType), log.Fields{"devices": len(failing)})
+		delete(q.types, devType)
+	}
+	q.account()
+}
+
+// quarantine func
+// lock must be held
+func (q *quarantineTable) quarantine(key string, fields log.Fields) {
+	until := time.Now().Add(q.cooldown)
+	fields["key"] = key
+	logger.WithFields(fields).Warnf("Decoding quarantined until %s", until.Format(time.RFC3339))
+	q.until[key] = until
+}
+
+// account func
+// lock must be held
+func (q *quarantineTable) account() {
+	decodersQuarantined.Set(float64(len(q.until)))
+}
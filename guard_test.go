@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// quarantineStep type
+// decoding outcome of one uplink of device, all on the same decoder type
+type quarantineStep struct {
+	deveui string
+	ok     bool
+}
+
+func TestQuarantineTable(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		after   int
+		steps   []quarantineStep
+		devices []string // quarantined in the end
+		decoder bool
+	}{
+		{"one device failing", 3, []quarantineStep{{"a", false}, {"a", false}, {"a", false}}, []string{"a"}, false},
+		{"distinct devices failing", 3, []quarantineStep{{"a", false}, {"b", false}, {"c", false}}, nil, true},
+		{"device below threshold", 3, []quarantineStep{{"a", false}, {"a", false}}, nil, false},
+		{"success resets device", 3, []quarantineStep{{"a", false}, {"a", false}, {"a", true}, {"a", false}}, nil, false},
+		{"success resets decoder", 3, []quarantineStep{{"a", false}, {"b", false}, {"c", true}, {"d", false}}, nil, false},
+		{"device and decoder", 2, []quarantineStep{{"a", false}, {"a", false}, {"b", false}}, []string{"a"}, true},
+		{"disabled", -1, []quarantineStep{{"a", false}, {"a", false}, {"b", false}, {"c", false}}, nil, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			q := newQuarantineTable(c.after, time.Hour)
+			for _, step := range c.steps {
+				if step.ok {
+					q.Success("acme", step.deveui)
+				} else {
+					q.Failure("acme", step.deveui)
+				}
+			}
+
+			quarantined := map[string]bool{}
+			for _, deveui := range c.devices {
+				quarantined[deveui] = true
+			}
+			for _, step := range c.steps {
+				// device alone, through decoder type nobody failed on
+				if err := q.Check("other", step.deveui); (err != nil) != quarantined[step.deveui] {
+					t.Fatalf("device %s: expected quarantined %v, got %v", step.deveui, quarantined[step.deveui], err)
+				}
+			}
+			if err := q.Check("acme", "fresh"); (err != nil) != c.decoder {
+				t.Fatalf("decoder: expected quarantined %v, got %v", c.decoder, err)
+			}
+		})
+	}
+}
+
+func TestQuarantineCooldown(t *testing.T) {
+	q := newQuarantineTable(1, 20*time.Millisecond)
+	q.Failure("acme", "a")
+	if err := q.Check("acme", "a"); err == nil {
+		t.Fatal("expected quarantine right after failure")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := q.Check("acme", "a"); err != nil {
+		t.Fatalf("expected quarantine lifted after cooldown, got %v", err)
+	}
+	if len(q.until) != 0 {
+		t.Fatalf("expected no quarantined keys left, got %v", q.until)
+	}
+}
+
+func TestGuardedDecode(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	for _, c := range []struct {
+		name   string
+		decode func(UplinkInput) (interface{}, error)
+		reason string
+	}{
+		{"success", func(UplinkInput) (interface{}, error) { return 1, nil }, ""},
+		{"error", func(UplinkInput) (interface{}, error) { return nil, errors.New("bad payload") }, decodeFailedError},
+		{"panic", func(UplinkInput) (interface{}, error) { panic("broken decoder") }, decodeFailedPanic},
+		{"timeout", func(UplinkInput) (interface{}, error) { <-release; return nil, nil }, decodeFailedTimeout},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			decoder := Decoder{Type: "acme", DecodeUplink: c.decode}
+			_, reason, err := guardedDecode(decoder, UplinkInput{DevEui: "a"}, 20*time.Millisecond)
+			if reason != c.reason {
+				t.Fatalf("expected reason %q, got %q (%v)", c.reason, reason, err)
+			}
+			if (err != nil) != (c.reason != "") {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// downlink states
+const (
+	downlinkQueued      = "queued"      // handed over to TCIO, waiting for device window
+	downlinkTransmitted = "transmitted" // dntxed, final for unconfirmed downlinks
+	downlinkAcked       = "acked"       // dnacked, final for confirmed downlinks
+	downlinkRejected    = "rejected"    // bad_dndf
+	downlinkCleared     = "cleared"     // dnclr, deleted or replaced in TCIO before delivery
+	downlinkFailed      = "failed"      // never reached TCIO
+	downlinkOutboxed    = "outboxed"    // no appx to write to, waiting in outbox for retry
+	downlinkExpired     = "expired"     // outboxed for longer than TTL
+	downlinkInvalid     = "invalid"     // refused by validation, never gets to ledger
+)
+
+// how many downlinks per device are kept for inspection
+const ledgerDeviceHistory = 20
+
+var ledger = newDownlinkLedger()
+
+var lastMsgID = time.Now().UnixNano() / int64(time.Microsecond)
+
+// nextMsgID func
+// unique and increasing within the process and across restarts
+func nextMsgID() int64 {
+	return atomic.AddInt64(&lastMsgID, 1)
+}
+
+// DownlinkEntry type
+type DownlinkEntry struct {
+	MsgID         int64      `json:"MsgId"`
+	DevEui        string     `json:"DevEui"`
+	FPort         uint8      `json:"FPort,omitempty"`
+	FRMPayload    string     `json:"FRMPayload,omitempty"`
+	Confirm       bool       `json:"confirm"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	RouterID      string     `json:"routerid,omitempty"`
+	Transmissions int        `json:"transmissions,omitempty"`
+	Targets       int        `json:"targets,omitempty"`    // appxs the downlink was written to, more than one on broadcast
+	Rejections    int        `json:"rejections,omitempty"` // bad_dndf answers, non-owners of broadcast downlink answer so
+	Submitted     *time.Time `json:"submitted,omitempty"`
+	Transmitted   *time.Time `json:"transmitted,omitempty"`
+	Acked         *time.Time `json:"acked,omitempty"`
+	Finished      *time.Time `json:"finished,omitempty"`
+}
+
+// Done func
+// nothing is going to happen with the downlink anymore
+func (e *DownlinkEntry) Done() bool {
+	switch e.Status {
+	case downlinkAcked, downlinkRejected, downlinkCleared, downlinkFailed, downlinkExpired:
+		return true
+	case downlinkTransmitted:
+		return !e.Confirm
+	}
+	return false
+}
+
+// downlinkLedger type
+// downlinks we have seen, keyed by MsgId, with short history per device
+type downlinkLedger struct {
+	entries map[int64]*DownlinkEntry
+	devices map[string][]int64
+	mu      sync.RWMutex
+}
+
+func newDownlinkLedger() *downlinkLedger {
+	return &downlinkLedger{
+		entries: make(map[int64]*DownlinkEntry),
+		devices: make(map[string][]int64),
+	}
+}
+
+// Submit func
+func (l *downlinkLedger) Submit(msg TracknetDnDfSpecialMsg) DownlinkEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entry := l.entry(msg.MsgID, msg.DevEui)
+	entry.FPort = msg.FPort
+	entry.FRMPayload = msg.FRMPayload
+	entry.Confirm = msg.Confirm
+	entry.Status = downlinkQueued
+	entry.Submitted = &now
+	return *entry
+}
+
+// Fail func
+func (l *downlinkLedger) Fail(msgID int64, reason string) (DownlinkEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[msgID]
+	if !ok {
+		return DownlinkEntry{}, false
+	}
+	l.finish(entry, downlinkFailed, reason)
+	return *entry, true
+}
+
+// Outbox func
+func (l *downlinkLedger) Outbox(msgID int64, reason string) (DownlinkEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[msgID]
+	if !ok {
+		return DownlinkEntry{}, false
+	}
+	entry.Status = downlinkOutboxed
+	entry.Error = reason
+	return *entry, true
+}
+
+// Targets func
+// set before the downlink is written out, so that no bad_dndf comes before it
+func (l *downlinkLedger) Targets(msg TracknetDnDfSpecialMsg, targets int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := l.entry(msg.MsgID, msg.DevEui)
+	entry.Targets = targets
+	entry.Rejections = 0
+}
+
+// Finish func
+// for outboxed downlinks, the entry may be gone already if it was outboxed before restart
+func (l *downlinkLedger) Finish(msg TracknetDnDfSpecialMsg, status string, reason string) DownlinkEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := l.entry(msg.MsgID, msg.DevEui)
+	entry.FPort = msg.FPort
+	entry.FRMPayload = msg.FRMPayload
+	entry.Confirm = msg.Confirm
+	l.finish(entry, status, reason)
+	return *entry
+}
+
+// Track func
+// correlates downlink lifecycle messages from TCIO, returns entries changed by the message
+func (l *downlinkLedger) Track(event *TrackNetMessage) []DownlinkEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	switch event.MsgType {
+	case "dntxed":
+		msgID, ok := parseMsgID(event.TracknetDnTxedMsg.MsgID)
+		if !ok {
+			return nil
+		}
+		entry := l.entry(msgID, event.DevEui)
+		entry.Confirm = event.TracknetDnTxedMsg.Confirm
+		entry.RouterID = string(event.TracknetDnTxedMsg.UpInfo.RouterID)
+		entry.Transmissions++
+		if entry.Transmitted == nil {
+			entry.Transmitted = &now
+			if entry.Submitted != nil {
+				downlinkTimeToTx.Observe(now.Sub(*entry.Submitted).Seconds())
+			}
+		}
+		// rejected by a broadcast target which is not the owner after all
+		if entry.Status == downlinkQueued || entry.Status == "" || entry.Status == downlinkRejected {
+			entry.Status = downlinkTransmitted
+			entry.Error = ""
+			entry.Finished = nil
+			if !entry.Confirm {
+				entry.Finished = &now
+			}
+		}
+		return []DownlinkEntry{*entry}
+	case "dnacked":
+		msgID, ok := parseMsgID(event.TracknetDnAckedMsg.MsgID)
+		if !ok {
+			return nil
+		}
+		entry := l.entry(msgID, event.DevEui)
+		entry.Acked = &now
+		if entry.Submitted != nil {
+			downlinkTimeToAck.Observe(now.Sub(*entry.Submitted).Seconds())
+		}
+		l.finish(entry, downlinkAcked, "")
+		return []DownlinkEntry{*entry}
+	case "bad_dndf":
+		msgID, ok := parseMsgID(event.TracknetBadDnDfMsg.MsgID)
+		if !ok {
+			return nil
+		}
+		entry := l.entry(msgID, event.DevEui)
+		entry.Rejections++
+		if entry.Targets > 1 {
+			// broadcast: the owner has taken it, or some targets are yet to answer
+			if entry.Status == downlinkTransmitted || entry.Status == downlinkAcked || entry.Rejections < entry.Targets {
+				return nil
+			}
+		}
+		l.finish(entry, downlinkRejected, event.TracknetBadDnDfMsg.Error)
+		return []DownlinkEntry{*entry}
+	case "dnclr":
+		// MsgId 0 stands for the whole device queue
+		if msgID, ok := parseMsgID(event.TracknetDnClrMsg.MsgID); ok {
+			entry := l.entry(msgID, event.DevEui)
+			l.finish(entry, downlinkCleared, "")
+			return []DownlinkEntry{*entry}
+		}
+		var cleared []DownlinkEntry
+		for _, msgID := range l.devices[event.DevEui] {
+			if entry, ok := l.entries[msgID]; ok && !entry.Done() {
+				l.finish(entry, downlinkCleared, "")
+				cleared = append(cleared, *entry)
+			}
+		}
+		return cleared
+	}
+	return nil
+}
+
+// Get func
+func (l *downlinkLedger) Get(msgID int64) (DownlinkEntry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if entry, ok := l.entries[msgID]; ok {
+		return *entry, true
+	}
+	return DownlinkEntry{}, false
+}
+
+// Device func
+// copies of the device downlinks, newest first
+func (l *downlinkLedger) Device(deveui string) []DownlinkEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	history := l.devices[deveui]
+	entries := make([]DownlinkEntry, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		if entry, ok := l.entries[history[i]]; ok {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// entry func
+// existing entry or a new one for downlinks submitted by someone else, lock must be held
+func (l *downlinkLedger) entry(msgID int64, deveui string) *DownlinkEntry {
+	if entry, ok := l.entries[msgID]; ok {
+		if entry.DevEui == "" && deveui != "" {
+			entry.DevEui = deveui
+		}
+		return entry
+	}
+
+	entry := &DownlinkEntry{MsgID: msgID, DevEui: deveui}
+	l.entries[msgID] = entry
+
+	history := append(l.devices[deveui], msgID)
+	if len(history) > ledgerDeviceHistory {
+		for _, old := range history[:len(history)-ledgerDeviceHistory] {
+			delete(l.entries, old)
+		}
+		history = history[len(history)-ledgerDeviceHistory:]
+	}
+	l.devices[deveui] = history
+	return entry
+}
+
+// finish func
+// lock must be held
+func (l *downlinkLedger) finish(entry *DownlinkEntry, status string, reason string) {
+	now := time.Now()
+	entry.Status = status
+	entry.Error = reason
+	entry.Finished = &now
+}
+
+func parseMsgID(id BigInt) (int64, bool) {
+	msgID, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil || msgID == 0 {
+		return 0, false
+	}
+	return msgID, true
+}
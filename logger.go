@@ -29,7 +29,6 @@ func init() {
 	logLevel = flag.String("l", "info", "logging level (info, error, critical, debug...)")
 	promPort = flag.String("p", "9002", "prometheus source port")
 	cpuprofile = flag.String("cp", "", "write cpu profile to file")
-	flag.Parse()
 
 	logger = logrus.New()
 
@@ -39,6 +38,13 @@ func init() {
 		DisableColors:   false,
 	}
 	logger.Formatter = formatter
+	logger.Out = os.Stdout
+}
+
+// SetupLogger func
+// flags are parsed in main, not in init, so go test can pass its own
+func SetupLogger() {
+	flag.Parse()
 
 	ll, err := logrus.ParseLevel(*logLevel)
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
@@ -27,6 +28,8 @@ var wggs = sync.WaitGroup{}
 var shutdown = make(chan struct{})
 
 func main() {
+	SetupLogger()
+	RunCommand(flag.Args())
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -41,12 +44,13 @@ func main() {
 	fmt.Printf("%s %s\nGIT Commit Hash: %s\nBuild Time: %s\n\n", ctx.AppName, version, githash, buildstamp)
 	ctx.LoadDecoders()
 	ctx.InitBackends()
+	affinity.SetStatic(ctx.Downlinks.Affinity)
 	appxProxyInfo.WithLabelValues(ctx.AppName, ctx.Owner.ID).Set(1)
 
 	appxMessage := make(chan AppxMessage, ctx.Owner.QueueFlushCount*3)
 
-	interrupt := make(chan os.Signal)
-	sighup := make(chan os.Signal)
+	interrupt := make(chan os.Signal, 1)
+	sighup := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
 	signal.Notify(sighup, syscall.SIGHUP)
 
@@ -71,6 +75,7 @@ func main() {
 				logger.Infoln("Reloading filters...")
 				ctx.ReloadConfig(*confFile)
 				logger.Infof("Reloading filters done. New is %+v", ctx.Filters)
+				ctx.ReloadDecoders()
 			}
 		}
 	}()
@@ -91,7 +96,7 @@ func main() {
 
 		conn := connection{
 			c, ctx, uri.URI,
-			uri.Appxid, true, 0}
+			uri.Appxid, true, 0, new(sync.Mutex)}
 		pool.Add(&conn)
 
 		go conn.ListenAppxNode(appxMessage)
@@ -101,8 +106,14 @@ func main() {
 	}
 
 	go ctx.QueueProcessing(appxMessage, &wggs)
+	go ctx.PublishStatuses()
+	go ctx.FlushOutbox()
+	go ctx.WatchOutbox()
+	go ctx.RunScheduler()
+	go ctx.WatchDecoders()
 
 	http.Handle("/metrics", promhttp.Handler())
+	ctx.ServeAPI()
 	panic(http.ListenAndServe(":"+*promPort, nil))
 	//select {}
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mqttModeBatch = "batch"
+	mqttModeEvent = "event"
+
+	mqttPayloadFull    = "full"
+	mqttPayloadDecoded = "decoded"
+
+	defaultMqttTopic = "{uptopic}/{appxid}/{DevEui}/{msgtype}"
+)
+
+// mqttClientOptions func
+// all brokers are added for failover, tls and auth are set up only as far as configured
+func (ctx *Context) mqttClientOptions() *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	secure := false
+
+	for _, broker := range ctx.Mqtt.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			logger.WithFields(log.Fields{"broker": broker}).Fatalf("Error parse mqtt broker uri %+v", err)
+		}
+		switch u.Scheme {
+		case "tcp", "ws":
+		case "ssl", "tls", "wss":
+			secure = true
+		default:
+			logger.WithFields(log.Fields{"broker": broker}).Fatalf("Unsupported mqtt broker scheme %s", u.Scheme)
+		}
+		opts.AddBroker(broker)
+	}
+
+	if (ctx.Mqtt.Certificate == "") != (ctx.Mqtt.PrivateKey == "") {
+		logger.WithFields(log.Fields{"crt": ctx.Mqtt.Certificate, "key": ctx.Mqtt.PrivateKey}).Fatalln("MQTT client certificate and private key go in pair")
+	}
+
+	if secure || ctx.Mqtt.CA != "" || ctx.Mqtt.Certificate != "" {
+		tlsConfig := &tls.Config{}
+		if ctx.Mqtt.CA != "" {
+			raw, err := ioutil.ReadFile(ctx.Mqtt.CA)
+			if err != nil {
+				logger.WithFields(log.Fields{"ca": ctx.Mqtt.CA}).Fatalf("Something goes wrong with MQTT CA loading %+v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(raw) {
+				logger.WithFields(log.Fields{"ca": ctx.Mqtt.CA}).Fatalln("No certificates found in MQTT CA file")
+			}
+		}
+		if ctx.Mqtt.Certificate != "" {
+			cer, err := tls.LoadX509KeyPair(ctx.Mqtt.Certificate, ctx.Mqtt.PrivateKey)
+			if err != nil {
+				logger.WithFields(log.Fields{"crt": ctx.Mqtt.Certificate, "key": ctx.Mqtt.PrivateKey}).Fatalf("Something goes wrong with MQTT SSL certs loading %+v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cer}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// client certificate is enough for some brokers, user/password for others, or both
+	if ctx.Mqtt.User != "" {
+		opts.SetUsername(ctx.Mqtt.User)
+		opts.SetPassword(ctx.Mqtt.Password)
+	}
+
+	// persistent session: broker keeps our subscription and qos 1/2 messages for the stable client id,
+	// in-flight ones survive restarts in the file store
+	opts.SetClientID(ctx.Mqtt.ClientID)
+	opts.SetCleanSession(false)
+	if ctx.Mqtt.Store != "" {
+		opts.SetStore(mqtt.NewFileStore(filepath.Clean(ctx.Mqtt.Store)))
+	}
+	opts.SetConnectTimeout(time.Second * 3)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(time.Second * 30)
+	opts.SetOnConnectHandler(ctx.mqttOnConnect)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		logger.Errorf("Mqtt disconnected: %+v, reconnecting...", err)
+	})
+
+	return opts
+}
+
+// mqttEventSink func
+// publishes every event on its own topic, and the latest decoded one as retained device state if configured
+func (ctx *Context) mqttEventSink(batch *[]interface{}) {
+	var messages []mqttMessage
+
+	start := time.Now()
+	for _, each := range *batch {
+		record, ok := encodeRecordPositions(each, geoJSONPosition).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		_, decoded := record["payload"]
+
+		var body interface{} = record
+		if ctx.Mqtt.Payload == mqttPayloadDecoded {
+			if !decoded {
+				continue
+			}
+			body = record["payload"]
+		}
+
+		data, err := json.Marshal(body)
+		if err != nil {
+			logger.Errorf("Can't convert event to json string: %+v", err)
+			mqttPublishFailed.Inc()
+			continue
+		}
+
+		messages = append(messages, mqttMessage{mqttTopic(ctx.Mqtt.Topic, ctx.Mqtt.UpTopic, record), ctx.Mqtt.UpQoS, false, data, 1})
+		if ctx.Mqtt.StateTopic != "" && decoded {
+			messages = append(messages, mqttMessage{mqttTopic(ctx.Mqtt.StateTopic, ctx.Mqtt.UpTopic, record), ctx.Mqtt.UpQoS, true, data, 0})
+		}
+	}
+
+	published, _, failed := ctx.mqttPublishAll(messages)
+	messagesPublishedToMqtt.Add(float64(published))
+	mqttPublishFailed.Add(float64(failed))
+
+	duration := time.Since(start)
+	mqttPublishHistogram.Observe(float64(duration.Nanoseconds() / int64(time.Millisecond)))
+}
+
+// mqttMessage type
+type mqttMessage struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  []byte
+	Events   int // number of events carried, for accounting only
+}
+
+// mqttPublishAll func
+// publishes messages and waits for all of them, while broker is unreachable they go to offline buffer.
+// Offline buffer and paho store never hold the same message: paho gets only messages published while connected,
+// with persistent session it keeps their qos 1/2 tokens pending over reconnect and resends them from the store,
+// so just what paho refused or lost (qos 0) is buffered here
+func (ctx *Context) mqttPublishAll(messages []mqttMessage) (published int, buffered int, failed int) {
+	type pending struct {
+		msg   mqttMessage
+		token mqtt.Token
+	}
+	var inflight []pending
+
+	for _, msg := range messages {
+		if !ctx.mqttClient.IsConnectionOpen() {
+			ctx.mqttOffline.Push(msg)
+			buffered += msg.Events
+			continue
+		}
+		inflight = append(inflight, pending{msg, ctx.mqttClient.Publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload)})
+	}
+
+	for _, each := range inflight {
+		if each.token.Wait() && each.token.Error() != nil {
+			if !ctx.mqttClient.IsConnectionOpen() {
+				ctx.mqttOffline.Push(each.msg)
+				buffered += each.msg.Events
+				continue
+			}
+			logger.Errorf("Failed to publish to MQTT topic %s: %+v", each.msg.Topic, each.token.Error())
+			failed += each.msg.Events
+			continue
+		}
+		published += each.msg.Events
+	}
+	return
+}
+
+// mqttOnConnect func
+// (re)subscribes the downlink topic and flushes whatever was published while offline
+func (ctx *Context) mqttOnConnect(c mqtt.Client) {
+	logger.Infoln("Mqtt connected")
+	if token := c.Subscribe(ctx.Mqtt.DnTopic, ctx.Mqtt.UpQoS, ctx.handleMqttDnMessage); token.Wait() && token.Error() != nil {
+		logger.Errorf("Error subscribe to mqtt dntopic %s: %+v", ctx.Mqtt.DnTopic, token.Error())
+	}
+
+	messages := ctx.mqttOffline.PopAll()
+	if len(messages) == 0 {
+		return
+	}
+	logger.Infof("Draining %v messages buffered while mqtt was offline", len(messages))
+	published, _, failed := ctx.mqttPublishAll(messages)
+	messagesPublishedToMqtt.Add(float64(published))
+	mqttPublishFailed.Add(float64(failed))
+}
+
+// mqttBuffer type
+// bounded fifo of messages waiting for broker, the oldest are dropped on overflow
+type mqttBuffer struct {
+	messages []mqttMessage
+	limit    int
+	mu       sync.Mutex
+}
+
+func newMqttBuffer(limit int) *mqttBuffer {
+	return &mqttBuffer{limit: limit}
+}
+
+// Push func
+func (b *mqttBuffer) Push(msg mqttMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.messages) >= b.limit {
+		if len(b.messages) > 0 {
+			logger.Warnf("Mqtt offline buffer is full, dropping message to %s", b.messages[0].Topic)
+			mqttOfflineDropped.Add(float64(b.messages[0].Events))
+			b.messages = b.messages[1:]
+		}
+		if b.limit <= 0 {
+			mqttOfflineDropped.Add(float64(msg.Events))
+			return
+		}
+	}
+	b.messages = append(b.messages, msg)
+	mqttOfflineBuffered.Set(float64(len(b.messages)))
+}
+
+// PopAll func
+func (b *mqttBuffer) PopAll() []mqttMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	messages := b.messages
+	b.messages = nil
+	mqttOfflineBuffered.Set(0)
+	return messages
+}
+
+// mqttTopic func
+// expands {uptopic}, {appxid}, {DevEui} and {msgtype} placeholders with event values
+func mqttTopic(template string, upTopic string, record map[string]interface{}) string {
+	return strings.NewReplacer(
+		"{uptopic}", upTopic,
+		"{appxid}", mqttTopicLevel(record["appxid"]),
+		"{DevEui}", mqttTopicLevel(record["DevEui"]),
+		"{msgtype}", mqttTopicLevel(record["msgtype"]),
+	).Replace(template)
+}
+
+// mqttTopicLevel func
+// keeps topic levels non empty and free of wildcards
+func mqttTopicLevel(value interface{}) string {
+	level := strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(fmt.Sprint(value))
+	if value == nil || level == "" {
+		return "-"
+	}
+	return level
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often expired outbox entries are looked for
+const outboxExpireInterval = 10 * time.Second
+
+// outboxed downlinks don't go by fallback policy, restored ones would all go there while affinity is being learned
+var errUnrouted = errors.New("appx of the device is not known yet, waiting for its uplink")
+
+// outboxEntry type
+type outboxEntry struct {
+	Msg       TracknetDnDfSpecialMsg `json:"msg"`
+	Queued    time.Time              `json:"queued"`
+	Expires   time.Time              `json:"expires"`
+	Attempts  int                    `json:"attempts"`
+	LastError string                 `json:"last_error,omitempty"`
+}
+
+// downlinkOutbox type
+// downlinks which couldn't be written to any appx, kept in file to survive restarts
+type downlinkOutbox struct {
+	path    string
+	ttl     time.Duration
+	entries []outboxEntry
+	mu      sync.Mutex
+	flushMu sync.Mutex // one flush at a time, otherwise the same downlink may go out twice
+}
+
+func newDownlinkOutbox(path string, ttl time.Duration) *downlinkOutbox {
+	o := downlinkOutbox{path: path, ttl: ttl}
+	if path == "" {
+		return &o
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &o
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"outbox": path}).Fatalf("Can't read downlink outbox %+v", err)
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &o.entries); err != nil {
+			logger.WithFields(log.Fields{"outbox": path}).Fatalf("Can't parse downlink outbox %+v", err)
+		}
+	}
+	if len(o.entries) > 0 {
+		logger.WithFields(log.Fields{"outbox": path}).Infof("%v downlinks restored from outbox", len(o.entries))
+	}
+	downlinkOutboxSize.Set(float64(len(o.entries)))
+	return &o
+}
+
+// Push func
+func (o *downlinkOutbox) Push(msg TracknetDnDfSpecialMsg, reason string) {
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = append(o.entries, outboxEntry{msg, now, now.Add(o.ttl), 1, reason})
+	o.save()
+}
+
+// Waits func
+// device has downlinks in outbox
+func (o *downlinkOutbox) Waits(deveui string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, entry := range o.entries {
+		if entry.Msg.DevEui == deveui {
+			return true
+		}
+	}
+	return false
+}
+
+// take func
+// removes and returns all entries, the ones still undelivered are put back with putBack
+func (o *downlinkOutbox) take() []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := o.entries
+	o.entries = nil
+	return entries
+}
+
+// putBack func
+// keeps the original order, entries pushed meanwhile go after them
+func (o *downlinkOutbox) putBack(entries []outboxEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = append(entries, o.entries...)
+	o.save()
+}
+
+// save func
+// rewrites the file via rename so a crash never leaves it half written, lock must be held
+func (o *downlinkOutbox) save() {
+	downlinkOutboxSize.Set(float64(len(o.entries)))
+	if o.path == "" {
+		return
+	}
+
+	raw, err := json.Marshal(o.entries)
+	if err != nil {
+		logger.Errorf("Can't marshal downlink outbox %+v", err)
+		return
+	}
+	tmp := o.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0666); err != nil {
+		logger.WithFields(log.Fields{"outbox": o.path}).Errorf("Can't write downlink outbox %+v", err)
+		return
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		logger.WithFields(log.Fields{"outbox": o.path}).Errorf("Can't replace downlink outbox %+v", err)
+	}
+}
+
+// expired func
+// removes and returns entries past their TTL
+func (o *downlinkOutbox) expired(now time.Time) []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var expired, keep []outboxEntry
+	for _, entry := range o.entries {
+		if now.After(entry.Expires) {
+			expired = append(expired, entry)
+		} else {
+			keep = append(keep, entry)
+		}
+	}
+	if len(expired) > 0 {
+		o.entries = keep
+		o.save()
+	}
+	return expired
+}
+
+// FlushOutbox func
+// resends outboxed downlinks, called when appx connection (re)appears and when device route is learned,
+// downlinks of devices with no route wait for it until TTL, unless fallback is broadcast which can't misroute
+func (ctx *Context) FlushOutbox() {
+	ctx.outbox.flushMu.Lock()
+	defer ctx.outbox.flushMu.Unlock()
+
+	changed := ctx.expireOutbox()
+	entries := ctx.outbox.take()
+	if len(entries) == 0 {
+		ctx.downlinkStatusChanged(changed...)
+		return
+	}
+
+	var keep []outboxEntry
+	for _, entry := range entries {
+		if _, route := affinity.Lookup(entry.Msg.DevEui); route == "fallback" && ctx.Downlinks.Fallback != fallbackBroadcast {
+			entry.LastError = errUnrouted.Error()
+			keep = append(keep, entry)
+			continue
+		}
+		entry.Attempts++
+		err := pool.SendDownlink(entry.Msg, ctx.Downlinks.Fallback)
+		if err == errDropped {
+			changed = append(changed, ledger.Finish(entry.Msg, downlinkFailed, err.Error()))
+			continue
+		}
+		if err != nil {
+			entry.LastError = err.Error()
+			keep = append(keep, entry)
+			continue
+		}
+		downlinkOutboxDelivered.Inc()
+		changed = append(changed, ledger.Submit(entry.Msg))
+	}
+
+	ctx.outbox.putBack(keep)
+	ctx.downlinkStatusChanged(changed...)
+}
+
+// expireOutbox func
+// fails expired downlinks for good, flush lock must be held
+func (ctx *Context) expireOutbox() []DownlinkEntry {
+	var changed []DownlinkEntry
+	for _, entry := range ctx.outbox.expired(time.Now()) {
+		logger.WithFields(log.Fields{"DevEui": entry.Msg.DevEui, "MsgId": entry.Msg.MsgID}).Warnf("Outboxed downlink expired after %v attempts, last error: %s", entry.Attempts, entry.LastError)
+		changed = append(changed, ledger.Finish(entry.Msg, downlinkExpired, entry.LastError))
+	}
+	return changed
+}
+
+// WatchOutbox func
+// expiration must not wait for appx to come back
+func (ctx *Context) WatchOutbox() {
+	ticker := time.NewTicker(outboxExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			ctx.outbox.flushMu.Lock()
+			expired := ctx.expireOutbox()
+			ctx.outbox.flushMu.Unlock()
+			ctx.downlinkStatusChanged(expired...)
+		}
+	}
+}
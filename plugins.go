@@ -0,0 +1,77 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+)
+
+// loadPluginDecoders func
+// every *.so in path must export Decoder (type name) and Decode, Version, DecodeUplink and Encode are optional
+func loadPluginDecoders(path string) ([]Decoder, error) {
+	allDecoders, err := filepath.Glob(path + "/*.so")
+	if err != nil {
+		return nil, fmt.Errorf("can't list decoders dir %s: %v", path, err)
+	}
+
+	var decoders []Decoder
+	for _, file := range allDecoders {
+		// try to load decoder
+		p, err := plugin.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't load decoder: %v", file, err)
+		}
+		// import descriptive type of decoder
+		decoderType, err := p.Lookup("Decoder")
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't import type of decoder: %v", file, err)
+		}
+		// import decoder method
+		decodeMethod, err := p.Lookup("Decode")
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't import decoder method: %v", file, err)
+		}
+		// malformed plugin fails the load, reload keeps the running registry then
+		typeName, ok := decoderType.(*string)
+		if !ok {
+			return nil, fmt.Errorf("%s: Decoder is %T, want *string", file, decoderType)
+		}
+		decode, ok := decodeMethod.(func(string) (interface{}, error))
+		if !ok {
+			return nil, fmt.Errorf("%s: decoder method has unexpected signature %T", file, decodeMethod)
+		}
+		decoder := Decoder{
+			Type:   *typeName,
+			Source: file,
+			Decode: decode,
+		}
+		if version, err := p.Lookup("Version"); err == nil {
+			if v, ok := version.(*string); ok {
+				decoder.Version = *v
+			}
+		}
+		// import optional decoder method knowing DevEui and FPort, preferred over Decode
+		if uplinkMethod, err := p.Lookup("DecodeUplink"); err == nil {
+			decodeUplink, ok := uplinkMethod.(func(string, uint8, string) (interface{}, error))
+			if !ok {
+				return nil, fmt.Errorf("%s: uplink decoder method has unexpected signature %T", file, uplinkMethod)
+			}
+			decoder.DecodeUplink = func(in UplinkInput) (interface{}, error) {
+				return decodeUplink(in.DevEui, in.FPort, in.FRMPayload)
+			}
+		}
+		// import optional encoder method for structured downlink commands
+		if encodeMethod, err := p.Lookup("Encode"); err == nil {
+			encode, ok := encodeMethod.(func(map[string]interface{}) (uint8, string, error))
+			if !ok {
+				return nil, fmt.Errorf("%s: encode method has unexpected signature %T", file, encodeMethod)
+			}
+			decoder.Encode = encode
+		}
+		decoders = append(decoders, decoder)
+	}
+	return decoders, nil
+}
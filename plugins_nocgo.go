@@ -0,0 +1,19 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loadPluginDecoders func
+// go plugins need cgo, static builds live with builtin decoders only
+func loadPluginDecoders(path string) ([]Decoder, error) {
+	if plugins, _ := filepath.Glob(path + "/*.so"); len(plugins) > 0 {
+		logger.WithFields(log.Fields{"path": path}).Warnf("Built without cgo, %v decoder plugins ignored", len(plugins))
+	}
+	return nil, nil
+}
@@ -94,6 +94,150 @@ var messagesDroppedFromMqtt = prometheus.NewCounterVec(
 	[]string{"error"},
 )
 
+var downlinksRouted = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_downlinks_routed",
+		Help: "Downlinks forwarded to TCIO by the way appx was chosen",
+	},
+	[]string{"route"},
+)
+
+var affinityDevices = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "appx_affinity_devices",
+		Help: "Devices with appx learned from uplinks",
+	},
+)
+
+var downlinkStatus = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_downlinks_status",
+		Help: "Downlinks reaching given state, failure rate is (rejected+failed)/queued",
+	},
+	[]string{"status"},
+)
+
+var downlinkTimeToTx = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "appx_downlink_time_to_tx_seconds",
+		Help:    "Time from downlink submission to first dntxed",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	},
+)
+
+var downlinkTimeToAck = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "appx_downlink_time_to_ack_seconds",
+		Help:    "Time from confirmed downlink submission to dnacked",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	},
+)
+
+var downlinksEncoded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_downlinks_encoded",
+		Help: "Downlink commands passed through device encoder",
+	},
+	[]string{"type", "result"},
+)
+
+var downlinkOutboxSize = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "appx_downlink_outbox_size",
+		Help: "Downlinks waiting in outbox for appx connection",
+	},
+)
+
+var downlinkOutboxDelivered = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "appx_downlink_outbox_delivered",
+		Help: "Outboxed downlinks delivered on retry",
+	},
+)
+
+var downlinkJobsScheduled = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "appx_downlink_jobs_scheduled",
+		Help: "Downlink jobs waiting for their time, uplink or device slot",
+	},
+)
+
+var downlinkJobs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_downlink_jobs",
+		Help: "Downlink jobs finished by scheduler",
+	},
+	[]string{"status"},
+)
+
+var downlinkJobsThrottled = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "appx_downlink_jobs_throttled",
+		Help: "Scheduler rounds cut short by global rate limit",
+	},
+)
+
+var decoderInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "appx_decoder_info",
+		Help: "Decoders in use by type, version and source",
+	},
+	[]string{"type", "version", "source"},
+)
+
+var decoderReloads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_decoder_reloads",
+		Help: "Decoders reloads on SIGHUP or file change",
+	},
+	[]string{"result"},
+)
+
+var decoderFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_decoder_failures",
+		Help: "Decoder calls failed by decoder type and reason (error, panic, timeout)",
+	},
+	[]string{"type", "reason"},
+)
+
+var decodersHung = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "appx_decoders_hung",
+		Help: "Decoder calls past deadline still running",
+	},
+)
+
+var decodersQuarantined = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "appx_decoders_quarantined",
+		Help: "Decoder types and devices in decoding quarantine",
+	},
+)
+
+var messagesDecodingSkipped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_messages_decoding_skipped",
+		Help: "Messages left undecoded on purpose, by device type and FPort",
+	},
+	[]string{"type", "fport"},
+)
+
+var messagesDecodingQuarantined = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "appx_messages_decoding_quarantined",
+		Help: "Messages stored undecoded because of quarantine",
+	},
+)
+
+var apiRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_api_requests",
+		Help: "REST API requests by result",
+	},
+	[]string{"result"},
+)
+
 var wsConnections = prometheus.NewGauge(
 	prometheus.GaugeOpts{
 		Name: "appx_ws_connections",
@@ -181,6 +325,20 @@ var mqttPublishFailed = prometheus.NewCounter(
 	},
 )
 
+var mqttOfflineBuffered = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "appx_mqtt_offline_buffered",
+		Help: "Messages waiting in MQTT offline buffer for reconnect",
+	},
+)
+
+var mqttOfflineDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "appx_mqtt_offline_dropped",
+		Help: "Messages dropped due to MQTT offline buffer overflow",
+	},
+)
+
 var elasticInsertFailed = prometheus.NewCounter(
 	prometheus.CounterOpts{
 		Name: "appx_elastic_messages_insert_fail",
@@ -188,6 +346,21 @@ var elasticInsertFailed = prometheus.NewCounter(
 	},
 )
 
+var elasticBulkItems = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "appx_elastic_bulk_items",
+		Help: "ElasticSearch bulk items by response status and error type",
+	},
+	[]string{"status", "error_type"},
+)
+
+var elasticBulkRetries = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "appx_elastic_bulk_retries",
+		Help: "ElasticSearch bulk items resubmitted after retryable failure",
+	},
+)
+
 var rethinkInsertFailed = prometheus.NewCounter(
 	prometheus.CounterOpts{
 		Name: "appx_rethink_messages_insert_fail",
@@ -195,6 +368,14 @@ var rethinkInsertFailed = prometheus.NewCounter(
 	},
 )
 
+var rethinkIndexReady = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "appx_rethink_index_ready",
+		Help: "RethinkDB secondary index state, 1 when built and ready",
+	},
+	[]string{"index"},
+)
+
 var queueTimeFlushTimes = prometheus.NewCounter(
 	prometheus.CounterOpts{
 		Name: "appx_queue_flushed_by_time",
@@ -230,9 +411,33 @@ func init() {
 		rethinkPublishHistogram,
 		elasticPublishHistogram,
 		mqttPublishFailed,
+		mqttOfflineBuffered,
+		mqttOfflineDropped,
 		elasticInsertFailed,
+		elasticBulkItems,
+		elasticBulkRetries,
 		rethinkInsertFailed,
+		rethinkIndexReady,
 		messagesForwardedToTcio,
+		downlinksRouted,
+		affinityDevices,
+		apiRequests,
+		downlinkStatus,
+		downlinkTimeToTx,
+		downlinkTimeToAck,
+		downlinksEncoded,
+		downlinkOutboxSize,
+		downlinkOutboxDelivered,
+		downlinkJobsScheduled,
+		downlinkJobs,
+		downlinkJobsThrottled,
+		decoderInfo,
+		decoderReloads,
+		decoderFailures,
+		decodersHung,
+		decodersQuarantined,
+		messagesDecodingQuarantined,
+		messagesDecodingSkipped,
 		messagesDecoderNotFound,
 		messagesLeavedWithoutDecoding,
 		queueTimeFlushTimes,
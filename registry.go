@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// where decoder comes from
+const decoderBuiltin = "builtin"
+
+// any FPort not listed for device type
+const fportWildcard = "*"
+
+// Decoder type
+// payload decoder for a device type, with optional encoder of downlink commands
+type Decoder struct {
+	Type    string
+	Version string
+	Source  string // builtin or plugin file
+	Decode  func(payload string) (interface{}, error)
+	Encode  func(command map[string]interface{}) (fport uint8, payload string, err error)
+	// DecodeUplink gets the whole uplink, decoders needing just the payload set Decode only
+	DecodeUplink func(in UplinkInput) (interface{}, error)
+}
+
+// UplinkInput type
+// what decoder gets to know about the uplink
+type UplinkInput struct {
+	DevEui     string
+	FPort      uint8
+	FRMPayload string // hex
+}
+
+// skippedFPortError type
+// uplink on a port decoder doesn't take, configuration acknowledgements and the like
+type skippedFPortError struct {
+	FPort uint8
+}
+
+func (e *skippedFPortError) Error() string {
+	return fmt.Sprintf("FPort %d is not decoded", e.FPort)
+}
+
+// compiled in decoders, filled by RegisterDecoder from init() of decoder files
+var builtinDecoders = make(map[string]Decoder)
+
+// RegisterDecoder func
+// decoder type must be unique among builtins, it's a programming error otherwise,
+// runs from init() of files going before logger.go, so it panics instead of logging
+func RegisterDecoder(decoder Decoder) {
+	if decoder.Type == "" || (decoder.Decode == nil && decoder.DecodeUplink == nil) {
+		panic(fmt.Sprintf("builtin decoder must have type and decode method: %+v", decoder))
+	}
+	if _, ok := builtinDecoders[decoder.Type]; ok {
+		panic(fmt.Sprintf("builtin decoder %s registered twice", decoder.Type))
+	}
+	decoder.Source = decoderBuiltin
+	builtinDecoders[decoder.Type] = decoder
+}
+
+// decoderRegistry type
+// decoders by device type, never changed once built, reload swaps the whole registry
+type decoderRegistry struct {
+	decoders map[string]Decoder
+	routes   map[string]fportRoutes // by device type
+}
+
+// fportRoutes type
+// decoder types by FPort of one device type
+type fportRoutes struct {
+	ports    map[uint8]string
+	fallback string // for ports not listed, "*" in config
+}
+
+// Registry func
+func (ctx *Context) Registry() *decoderRegistry {
+	registry, _ := ctx.registry.Load().(*decoderRegistry)
+	if registry == nil {
+		return &decoderRegistry{}
+	}
+	return registry
+}
+
+// Decoder func
+func (r *decoderRegistry) Decoder(devType string) (Decoder, bool) {
+	decoder, ok := r.decoders[devType]
+	return decoder, ok
+}
+
+// Route func
+// decoder type for device type uplinks on fport, false when the port is not decoded,
+// device types without fports config go to the decoder of the same name
+func (r *decoderRegistry) Route(devType string, fport uint8) (string, bool) {
+	routes, ok := r.routes[devType]
+	if !ok {
+		return devType, true
+	}
+	decoderType, ok := routes.ports[fport]
+	if !ok {
+		decoderType = routes.fallback
+	}
+	return decoderType, decoderType != ""
+}
+
+// Encoder func
+// encoder for device type commands, device types with fports config take the one of "*" decoder,
+// then of decoder with device type name, then of decoders by FPort in port order
+func (r *decoderRegistry) Encoder(devType string) (Decoder, bool) {
+	routes, ok := r.routes[devType]
+	if !ok {
+		decoder, ok := r.decoders[devType]
+		return decoder, ok && decoder.Encode != nil
+	}
+
+	candidates := []string{routes.fallback, devType}
+	ports := make([]int, 0, len(routes.ports))
+	for port := range routes.ports {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		candidates = append(candidates, routes.ports[uint8(port)])
+	}
+	for _, decoderType := range candidates {
+		if decoder, ok := r.decoders[decoderType]; ok && decoder.Encode != nil {
+			return decoder, true
+		}
+	}
+	return Decoder{}, false
+}
+
+// buildRegistry func
+// builtins first, then plugins, specs and scripts from decoders path, the later source wins on the same type
+func buildRegistry(config DecodersConfig) (*decoderRegistry, error) {
+	registry := decoderRegistry{decoders: make(map[string]Decoder)}
+	for devType, decoder := range builtinDecoders {
+		registry.decoders[devType] = decoder
+	}
+
+	plugins, err := loadPluginDecoders(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := loadSpecDecoders(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	scripts, err := loadScriptDecoders(config.Path, time.Duration(config.Timeout)*time.Millisecond, config.MemoryLimit<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, decoders := range [][]Decoder{plugins, specs, scripts} {
+		for _, decoder := range decoders {
+			if other, ok := registry.decoders[decoder.Type]; ok {
+				logger.WithFields(log.Fields{"type": decoder.Type, "source": decoder.Source}).Warnf("Decoder overrides %s from %s", other.Version, other.Source)
+			}
+			registry.decoders[decoder.Type] = decoder
+		}
+	}
+	// decoders taking payload only get the uplink adapter
+	for devType, decoder := range registry.decoders {
+		if decoder.DecodeUplink == nil {
+			decode := decoder.Decode
+			decoder.DecodeUplink = func(in UplinkInput) (interface{}, error) { return decode(in.FRMPayload) }
+			registry.decoders[devType] = decoder
+		}
+	}
+
+	// fports config is checked against loaded decoders, a typo would leave ports silently undecoded
+	// ports are normalized to numbers, so "01" is the same port as "1"
+	registry.routes = make(map[string]fportRoutes, len(config.FPorts))
+	for devType, ports := range config.FPorts {
+		routes := fportRoutes{ports: make(map[uint8]string, len(ports))}
+		for port, decoderType := range ports {
+			if _, ok := registry.decoders[decoderType]; decoderType != "" && !ok {
+				return nil, fmt.Errorf("fports of %s: FPort %s maps to unknown decoder %s", devType, port, decoderType)
+			}
+			if port == fportWildcard {
+				routes.fallback = decoderType
+				continue
+			}
+			n, err := strconv.ParseUint(port, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("fports of %s: bad FPort %q", devType, port)
+			}
+			if _, ok := routes.ports[uint8(n)]; ok {
+				return nil, fmt.Errorf("fports of %s: FPort %d is listed twice", devType, n)
+			}
+			routes.ports[uint8(n)] = decoderType
+		}
+		registry.routes[devType] = routes
+	}
+	return &registry, nil
+}
+
+// account func
+func (r *decoderRegistry) account() {
+	decoderInfo.Reset()
+	for devType, decoder := range r.decoders {
+		decoderInfo.WithLabelValues(devType, decoder.Version, decoder.Source).Set(1)
+	}
+}
+
+// ReloadDecoders func
+// on any load error the running registry stays, go plugins can't be unloaded
+// so changed plugin has to come under new file name,
+// SIGHUP and watcher reloads take turns, so registry swap and its metrics don't interleave
+func (ctx *Context) ReloadDecoders() {
+	ctx.decodersMu.Lock()
+	defer ctx.decodersMu.Unlock()
+
+	registry, err := buildRegistry(ctx.Decoders)
+	if err != nil {
+		logger.WithFields(log.Fields{"path": ctx.Decoders.Path}).Errorf("Decoders reload failed, keeping the running ones: %v", err)
+		decoderReloads.WithLabelValues("failed").Inc()
+		return
+	}
+
+	previous := ctx.Registry()
+	for devType, decoder := range registry.decoders {
+		old, ok := previous.decoders[devType]
+		switch {
+		case !ok:
+			logger.WithFields(log.Fields{"type": devType, "version": decoder.Version, "source": decoder.Source}).Infoln("Decoder added")
+		case old.Version != decoder.Version || old.Source != decoder.Source:
+			logger.WithFields(log.Fields{"type": devType, "version": decoder.Version, "was": old.Version, "source": decoder.Source}).Infoln("Decoder updated")
+		}
+	}
+	for devType, old := range previous.decoders {
+		if _, ok := registry.decoders[devType]; !ok {
+			logger.WithFields(log.Fields{"type": devType, "version": old.Version, "source": old.Source}).Infoln("Decoder removed")
+		}
+	}
+
+	ctx.registry.Store(registry)
+	registry.account()
+	decoderReloads.WithLabelValues("success").Inc()
+}
+
+// WatchDecoders func
+// polls decoders path and reloads when any decoder file appears, disappears or changes
+func (ctx *Context) WatchDecoders() {
+	if ctx.Decoders.Watch <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(ctx.Decoders.Watch) * time.Second)
+	defer ticker.Stop()
+
+	last := decodersFingerprint(ctx.Decoders.Path)
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			if current := decodersFingerprint(ctx.Decoders.Path); current != last {
+				logger.WithFields(log.Fields{"path": ctx.Decoders.Path}).Infoln("Decoders changed, reloading")
+				ctx.ReloadDecoders()
+				last = current
+			}
+		}
+	}
+}
+
+// decodersFingerprint func
+// names, sizes and modification times of decoder files
+func decodersFingerprint(path string) string {
+	var fingerprint []string
+	for _, pattern := range []string{"/*.so", "/*.yaml", "/*.js"} {
+		files, _ := filepath.Glob(path + pattern)
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				fingerprint = append(fingerprint, fmt.Sprintf("%s:%d:%d", file, info.Size(), info.ModTime().UnixNano()))
+			}
+		}
+	}
+	sort.Strings(fingerprint)
+	return strings.Join(fingerprint, "|")
+}
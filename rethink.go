@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	re "gopkg.in/gorethink/gorethink.v4"
+)
+
+// rethinkIndex type
+type rethinkIndex struct {
+	Name string
+	Geo  bool
+	Func func(row re.Term) interface{}
+}
+
+// rethinkIndexes func
+// secondary indexes we are querying the collection with
+func (ctx *Context) rethinkIndexes() []rethinkIndex {
+	return []rethinkIndex{
+		{Name: "DevEui"},
+		{Name: "msgtype"},
+		{Name: "ArrTime"},
+		{Name: "DevEui_ArrTime", Func: func(row re.Term) interface{} {
+			return []interface{}{row.Field("DevEui"), row.Field("ArrTime")}
+		}},
+		{Name: "position", Geo: true, Func: func(row re.Term) interface{} {
+			for _, field := range strings.Split(ctx.RethinkDB.GeoField, ".") {
+				row = row.Field(field)
+			}
+			return row
+		}},
+	}
+}
+
+// ProvisionRethink func
+// creates database, table and indexes if they are missing, existing ones are left as is
+func (ctx *Context) ProvisionRethink() {
+	var names []string
+
+	if err := re.DBList().Contains(ctx.RethinkDB.DB).Branch(
+		nil,
+		re.DBCreate(ctx.RethinkDB.DB),
+	).Exec(ctx.reSession); err != nil {
+		logger.WithFields(log.Fields{"db": ctx.RethinkDB.DB}).Fatalf("Can't create rethinkdb database %+v", err)
+	}
+
+	opts := re.TableCreateOpts{}
+	if ctx.RethinkDB.Shards > 0 {
+		opts.Shards = ctx.RethinkDB.Shards
+	}
+	if ctx.RethinkDB.Replicas > 0 {
+		opts.Replicas = ctx.RethinkDB.Replicas
+	}
+	db := re.DB(ctx.RethinkDB.DB)
+	if err := db.TableList().Contains(ctx.RethinkDB.Collection).Branch(
+		nil,
+		db.TableCreate(ctx.RethinkDB.Collection, opts),
+	).Exec(ctx.reSession); err != nil {
+		logger.WithFields(log.Fields{"db": ctx.RethinkDB.DB, "table": ctx.RethinkDB.Collection}).Fatalf("Can't create rethinkdb table %+v", err)
+	}
+
+	table := db.Table(ctx.RethinkDB.Collection)
+	cursor, err := table.IndexList().Run(ctx.reSession)
+	if err != nil {
+		logger.WithFields(log.Fields{"table": ctx.RethinkDB.Collection}).Fatalf("Can't list rethinkdb indexes %+v", err)
+	}
+	var existing []string
+	if err = cursor.All(&existing); err != nil {
+		logger.WithFields(log.Fields{"table": ctx.RethinkDB.Collection}).Fatalf("Can't read rethinkdb indexes %+v", err)
+	}
+
+	for _, index := range ctx.rethinkIndexes() {
+		names = append(names, index.Name)
+		if stringInSlice(index.Name, existing) {
+			continue
+		}
+
+		var create re.Term
+		opts := re.IndexCreateOpts{}
+		if index.Geo {
+			opts.Geo = true
+		}
+		if index.Func != nil {
+			create = table.IndexCreateFunc(index.Name, index.Func, opts)
+		} else {
+			create = table.IndexCreate(index.Name, opts)
+		}
+		if _, err := create.RunWrite(ctx.reSession); err != nil {
+			logger.WithFields(log.Fields{"table": ctx.RethinkDB.Collection, "index": index.Name}).Fatalf("Can't create rethinkdb index %+v", err)
+		}
+		logger.Infof("RethinkDB index %s created on %s.%s", index.Name, ctx.RethinkDB.DB, ctx.RethinkDB.Collection)
+	}
+
+	go ctx.watchRethinkIndexes(names)
+}
+
+// watchRethinkIndexes func
+// index build is running in background on rethinkdb side, follow it till the end
+func (ctx *Context) watchRethinkIndexes(names []string) {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	args := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		args = append(args, name)
+	}
+
+	for {
+		var (
+			statuses []map[string]interface{}
+			building int
+		)
+
+		cursor, err := re.DB(ctx.RethinkDB.DB).Table(ctx.RethinkDB.Collection).IndexStatus(args...).Run(ctx.reSession)
+		if err == nil {
+			err = cursor.All(&statuses)
+		}
+		if err != nil {
+			logger.Errorf("Can't get rethinkdb index status %+v", err)
+		}
+
+		for _, status := range statuses {
+			name, _ := status["index"].(string)
+			if ready, _ := status["ready"].(bool); ready {
+				rethinkIndexReady.WithLabelValues(name).Set(1)
+				continue
+			}
+			building++
+			rethinkIndexReady.WithLabelValues(name).Set(0)
+			logger.Infof("RethinkDB index %s is building, progress %v", name, status["progress"])
+		}
+
+		if err == nil && building == 0 {
+			logger.Infof("RethinkDB indexes %v are ready", names)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, each := range list {
+		if each == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// job states
+const (
+	jobScheduled = "scheduled" // waiting for its time, uplink, rate limit or device slot
+	jobSubmitted = "submitted" // handed over to SubmitDownlink, follow it by MsgId
+	jobFailed    = "failed"    // refused by validation or encoder
+	jobCancelled = "cancelled" // via api
+	jobReplaced  = "replaced"  // newer job for the device came with replace policy
+)
+
+// pending downlink policies
+const (
+	pendingReplace = "replace"
+	pendingAppend  = "append"
+)
+
+const (
+	schedulerTick = time.Second
+	// device slot is freed anyway if TCIO never told us what happened to the downlink
+	schedulerPendingTimeout = time.Hour
+	// finished jobs stay visible in api for a while
+	jobRetention = 24 * time.Hour
+)
+
+// DownlinkJob type
+type DownlinkJob struct {
+	ID       int64                  `json:"id"`
+	DevEui   string                 `json:"DevEui"`
+	Downlink TracknetDnDfSpecialMsg `json:"downlink"`
+	At       *time.Time             `json:"at,omitempty"`        // not before
+	OnUplink bool                   `json:"on_uplink,omitempty"` // with the next uplink after the job was created
+	Status   string                 `json:"status"`
+	Error    string                 `json:"error,omitempty"`
+	MsgID    int64                  `json:"MsgId,omitempty"`
+	Group    int64                  `json:"group,omitempty"` // group downlink the job was expanded from
+	Created  time.Time              `json:"created"`
+	Finished *time.Time             `json:"finished,omitempty"`
+}
+
+// downlinkScheduler type
+// keeps jobs per device in order, at most one downlink per device is in flight since TCIO
+// holds a single dndf per device window
+type downlinkScheduler struct {
+	path           string
+	policy         string
+	deviceInterval time.Duration
+	globalRate     float64   // tokens per second, 0 is unlimited
+	tokens         float64   // global rate bucket, holds a second worth of tokens at most
+	refilled       time.Time // last bucket refill
+	jobs           map[int64]*DownlinkJob
+	uplinks        map[string]time.Time // last uplink per device
+	inflight       map[string]int64     // last submitted MsgId per device
+	sent           map[string]time.Time // last submission per device
+	wake           chan struct{}
+	mu             sync.Mutex
+}
+
+func newDownlinkScheduler(path string, policy string, deviceInterval time.Duration, globalRate float64) *downlinkScheduler {
+	s := downlinkScheduler{
+		path:           path,
+		policy:         policy,
+		deviceInterval: deviceInterval,
+		globalRate:     globalRate,
+		tokens:         math.Max(globalRate, 1),
+		refilled:       time.Now(),
+		jobs:           make(map[int64]*DownlinkJob),
+		uplinks:        make(map[string]time.Time),
+		inflight:       make(map[string]int64),
+		sent:           make(map[string]time.Time),
+		wake:           make(chan struct{}, 1),
+	}
+	if path == "" {
+		return &s
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &s
+	}
+	if err != nil {
+		logger.WithFields(log.Fields{"jobs": path}).Fatalf("Can't read downlink jobs %+v", err)
+	}
+	var jobs []*DownlinkJob
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &jobs); err != nil {
+			logger.WithFields(log.Fields{"jobs": path}).Fatalf("Can't parse downlink jobs %+v", err)
+		}
+	}
+	for _, job := range jobs {
+		s.jobs[job.ID] = job
+	}
+	logger.WithFields(log.Fields{"jobs": path}).Infof("%v downlink jobs restored", len(jobs))
+	s.account()
+	return &s
+}
+
+// Add func
+// with replace policy jobs still waiting for the device are superseded by the new one
+func (s *downlinkScheduler) Add(job DownlinkJob, policy string) DownlinkJob {
+	if policy == "" {
+		policy = s.policy
+	}
+
+	s.mu.Lock()
+	added := s.add(job, policy)
+	s.save()
+	s.mu.Unlock()
+
+	s.Wake()
+	return added
+}
+
+// add func
+// lock must be held
+func (s *downlinkScheduler) add(job DownlinkJob, policy string) DownlinkJob {
+	job.ID = nextMsgID()
+	job.Status = jobScheduled
+	job.Created = time.Now()
+	if policy == pendingReplace {
+		for _, other := range s.jobs {
+			if other.DevEui == job.DevEui && other.Status == jobScheduled {
+				s.finish(other, jobReplaced, "")
+			}
+		}
+	}
+	s.jobs[job.ID] = &job
+	return job
+}
+
+// Cancel func
+func (s *downlinkScheduler) Cancel(id int64) (DownlinkJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return DownlinkJob{}, false
+	}
+	if job.Status == jobScheduled {
+		s.finish(job, jobCancelled, "")
+		s.save()
+	}
+	return *job, true
+}
+
+// Get func
+func (s *downlinkScheduler) Get(id int64) (DownlinkJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		return *job, true
+	}
+	return DownlinkJob{}, false
+}
+
+// List func
+// copies of jobs, optionally of one device only, oldest first
+func (s *downlinkScheduler) List(deveui string) []DownlinkJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]DownlinkJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if deveui == "" || job.DevEui == deveui {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// Uplink func
+// remembers the uplink time, jobs waiting for it may go now
+func (s *downlinkScheduler) Uplink(deveui string) {
+	s.mu.Lock()
+	s.uplinks[deveui] = time.Now()
+	s.mu.Unlock()
+	s.Wake()
+}
+
+// Wake func
+func (s *downlinkScheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due func
+// picks jobs allowed to go now, the oldest scheduled job per device only, lock must be held
+func (s *downlinkScheduler) due(now time.Time) []*DownlinkJob {
+	var (
+		heads = make(map[string]*DownlinkJob)
+		due   []*DownlinkJob
+	)
+	for _, job := range s.jobs {
+		if job.Status != jobScheduled {
+			continue
+		}
+		if head, ok := heads[job.DevEui]; !ok || job.ID < head.ID {
+			heads[job.DevEui] = job
+		}
+	}
+
+	for deveui, job := range heads {
+		if job.At != nil && now.Before(*job.At) {
+			continue
+		}
+		if job.OnUplink && !s.uplinks[deveui].After(job.Created) {
+			continue
+		}
+		if s.busy(deveui, now) {
+			continue
+		}
+		due = append(due, job)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	return due
+}
+
+// busy func
+// device has downlink in flight or was served too recently, lock must be held
+func (s *downlinkScheduler) busy(deveui string, now time.Time) bool {
+	if sent, ok := s.sent[deveui]; ok {
+		if now.Sub(sent) < s.deviceInterval {
+			return true
+		}
+		if msgID, ok := s.inflight[deveui]; ok && now.Sub(sent) < schedulerPendingTimeout {
+			if entry, ok := ledger.Get(msgID); ok && !entry.Done() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// take func
+// token bucket for global rate, lets global_rate jobs per second go in a single tick, lock must be held
+func (s *downlinkScheduler) take(now time.Time) bool {
+	if s.globalRate <= 0 {
+		return true
+	}
+	s.tokens = math.Min(s.tokens+now.Sub(s.refilled).Seconds()*s.globalRate, math.Max(s.globalRate, 1))
+	s.refilled = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// finish func
+// lock must be held
+func (s *downlinkScheduler) finish(job *DownlinkJob, status string, reason string) {
+	now := time.Now()
+	job.Status = status
+	job.Error = reason
+	job.Finished = &now
+}
+
+// prune func
+// lock must be held
+func (s *downlinkScheduler) prune(now time.Time) bool {
+	pruned := false
+	for id, job := range s.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > jobRetention {
+			delete(s.jobs, id)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// account func
+// lock must be held
+func (s *downlinkScheduler) account() {
+	scheduled := 0
+	for _, job := range s.jobs {
+		if job.Status == jobScheduled {
+			scheduled++
+		}
+	}
+	downlinkJobsScheduled.Set(float64(scheduled))
+}
+
+// save func
+// same as outbox, the file is replaced via rename, lock must be held
+func (s *downlinkScheduler) save() {
+	s.account()
+	if s.path == "" {
+		return
+	}
+
+	jobs := make([]*DownlinkJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	raw, err := json.Marshal(jobs)
+	if err != nil {
+		logger.Errorf("Can't marshal downlink jobs %+v", err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0666); err != nil {
+		logger.WithFields(log.Fields{"jobs": s.path}).Errorf("Can't write downlink jobs %+v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		logger.WithFields(log.Fields{"jobs": s.path}).Errorf("Can't replace downlink jobs %+v", err)
+	}
+}
+
+// RunScheduler func
+// submits due jobs on every tick and uplink, keeping per device and global rate limits
+func (ctx *Context) RunScheduler() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+		case <-ctx.scheduler.wake:
+		}
+		ctx.dispatchJobs()
+	}
+}
+
+// dispatchJob type
+type dispatchJob struct {
+	job  *DownlinkJob
+	msg  TracknetDnDfSpecialMsg
+	sent time.Time // previous submission to the device
+	err  error
+}
+
+// dispatchJobs func
+// due jobs are taken under the lock and submitted without it, SubmitDownlink does appx I/O
+// and uplinks and api must not wait for it
+func (ctx *Context) dispatchJobs() {
+	s := ctx.scheduler
+	s.mu.Lock()
+	now := time.Now()
+	changed := s.prune(now)
+	var batch []dispatchJob
+	for _, job := range s.due(now) {
+		if !s.take(now) {
+			downlinkJobsThrottled.Inc()
+			break
+		}
+		msg := job.Downlink
+		msg.DevEui = job.DevEui
+		batch = append(batch, dispatchJob{job: job, msg: msg, sent: s.sent[job.DevEui]})
+		// cancel and replace leave submitted jobs alone, the device is taken until the result is known
+		s.finish(job, jobSubmitted, "")
+		s.sent[job.DevEui] = now
+	}
+	s.mu.Unlock()
+
+	for i := range batch {
+		batch[i].err = ctx.SubmitDownlink(&batch[i].msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, each := range batch {
+		job, err := each.job, each.err
+		if err != nil {
+			if _, invalid := err.(*DownlinkError); !invalid {
+				// dropped by fallback policy, everything else is outboxed by SubmitDownlink
+				logger.WithFields(log.Fields{"DevEui": job.DevEui, "job": job.ID}).Errorf("Scheduled downlink not sent %+v", err)
+				job.MsgID = each.msg.MsgID
+			}
+			s.finish(job, jobFailed, err.Error())
+			s.sent[job.DevEui] = each.sent
+			if each.sent.IsZero() {
+				delete(s.sent, job.DevEui)
+			}
+			downlinkJobs.WithLabelValues(jobFailed).Inc()
+			continue
+		}
+
+		job.MsgID = each.msg.MsgID
+		s.inflight[job.DevEui] = each.msg.MsgID
+		s.sent[job.DevEui] = time.Now()
+		downlinkJobs.WithLabelValues(jobSubmitted).Inc()
+	}
+	if changed || len(batch) > 0 {
+		s.save()
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// script decoder bounds besides timeout and memory limit
+const (
+	scriptMaxCallStack = 256       // nested calls, deep recursion would grow goroutine stack instead
+	scriptMaxInput     = 255       // bytes, LoRaWAN frame can't carry more
+	scriptMaxOutput    = 64 * 1024 // bytes of decoded json
+)
+
+// how often allocations of running script are checked
+const scriptWatchInterval = 10 * time.Millisecond
+
+// scriptDecoder type
+// vendor payload formatter, TTN (decodeUplink(input), Decoder(bytes, port)) or ChirpStack (Decode(fPort, bytes, variables)) flavour
+type scriptDecoder struct {
+	file        string
+	program     *goja.Program
+	timeout     time.Duration
+	memoryLimit int64 // bytes, 0 or less disables
+}
+
+// loadScriptDecoders func
+// every *.js in path is a decoder, device type is the file name without extension
+func loadScriptDecoders(path string, timeout time.Duration, memoryLimit int64) ([]Decoder, error) {
+	scripts, err := filepath.Glob(path + "/*.js")
+	if err != nil {
+		return nil, fmt.Errorf("can't list decoders dir %s: %v", path, err)
+	}
+
+	var decoders []Decoder
+	for _, file := range scripts {
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't read decoder script: %v", file, err)
+		}
+		program, err := goja.Compile(file, string(source), false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't compile decoder script: %v", file, err)
+		}
+		script := &scriptDecoder{file, program, timeout, memoryLimit}
+		sum := sha1.Sum(source)
+		decoders = append(decoders, Decoder{
+			Type:         strings.TrimSuffix(filepath.Base(file), ".js"),
+			Version:      hex.EncodeToString(sum[:4]),
+			Source:       file,
+			DecodeUplink: script.Decode,
+		})
+	}
+	return decoders, nil
+}
+
+// Decode func
+// every call runs in fresh runtime, so scripts can't leak state or memory between uplinks
+func (s *scriptDecoder) Decode(in UplinkInput) (interface{}, error) {
+	result, err := s.decode(in)
+	if result == nil {
+		return nil, err
+	}
+	if encoded, merr := json.Marshal(result); merr != nil {
+		return nil, fmt.Errorf("%s returned value not representable as json: %v", s.file, merr)
+	} else if len(encoded) > scriptMaxOutput {
+		return nil, fmt.Errorf("%s returned %v bytes, over %v bytes limit", s.file, len(encoded), scriptMaxOutput)
+	}
+	return result, err
+}
+
+func (s *scriptDecoder) decode(in UplinkInput) (result interface{}, err error) {
+	raw, err := hex.DecodeString(in.FRMPayload)
+	if err != nil {
+		return nil, fmt.Errorf("payload %s is not hex: %v", in.FRMPayload, err)
+	}
+	if len(raw) > scriptMaxInput {
+		return nil, fmt.Errorf("payload of %v bytes is over %v bytes limit", len(raw), scriptMaxInput)
+	}
+
+	vm := goja.New()
+	vm.SetMaxCallStackSize(scriptMaxCallStack)
+	bytes := make([]interface{}, len(raw))
+	for i, b := range raw {
+		bytes[i] = int64(b)
+	}
+	jsBytes := vm.NewArray(bytes...)
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.watch(vm, done)
+
+	if _, err := vm.RunProgram(s.program); err != nil {
+		return nil, scriptError(err)
+	}
+
+	var value goja.Value
+	if fn, ok := goja.AssertFunction(vm.Get("decodeUplink")); ok {
+		input := vm.NewObject()
+		input.Set("bytes", jsBytes)
+		input.Set("fPort", in.FPort)
+		input.Set("devEui", in.DevEui)
+		if value, err = fn(goja.Undefined(), input); err != nil {
+			return nil, scriptError(err)
+		}
+		return uplinkResult(value)
+	} else if fn, ok := goja.AssertFunction(vm.Get("Decode")); ok {
+		variables := vm.NewObject()
+		variables.Set("DevEui", in.DevEui)
+		value, err = fn(goja.Undefined(), vm.ToValue(in.FPort), jsBytes, variables)
+	} else if fn, ok := goja.AssertFunction(vm.Get("Decoder")); ok {
+		value, err = fn(goja.Undefined(), jsBytes, vm.ToValue(in.FPort))
+	} else {
+		return nil, fmt.Errorf("%s defines none of decodeUplink, Decode or Decoder", s.file)
+	}
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	return value.Export(), nil
+}
+
+// watch func
+// interrupts script running longer than timeout or allocating over the limit,
+// goja has no per runtime accounting, so allocations of the whole process during the call are counted
+func (s *scriptDecoder) watch(vm *goja.Runtime, done <-chan struct{}) {
+	deadline := time.NewTimer(s.timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(scriptWatchInterval)
+	defer ticker.Stop()
+
+	start := scriptAllocated()
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline.C:
+			vm.Interrupt(fmt.Sprintf("timeout %v exceeded", s.timeout))
+			return
+		case <-ticker.C:
+			if s.memoryLimit > 0 && scriptAllocated()-start > uint64(s.memoryLimit) {
+				vm.Interrupt(fmt.Sprintf("memory limit %v MB exceeded", s.memoryLimit>>20))
+				return
+			}
+		}
+	}
+}
+
+func scriptAllocated() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.TotalAlloc
+}
+
+// uplinkResult func
+// decodeUplink returns {data, warnings, errors}, errors fail the decoding
+func uplinkResult(value goja.Value) (interface{}, error) {
+	result, ok := value.Export().(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("decodeUplink returned %T instead of object", value.Export())
+	}
+	if errs, ok := result["errors"].([]interface{}); ok && len(errs) > 0 {
+		return result["data"], fmt.Errorf("decodeUplink errors: %v", errs)
+	}
+	if warnings, ok := result["warnings"].([]interface{}); ok && len(warnings) > 0 {
+		logger.Warnf("decodeUplink warnings: %v", warnings)
+	}
+	return result["data"], nil
+}
+
+func scriptError(err error) error {
+	if interrupted, ok := err.(*goja.InterruptedError); ok {
+		return fmt.Errorf("script interrupted: %v", interrupted.Value())
+	}
+	if _, ok := err.(*goja.StackOverflowError); ok {
+		return fmt.Errorf("script call stack over %v frames", scriptMaxCallStack)
+	}
+	return err
+}
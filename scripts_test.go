@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestScript func
+// single decodeUplink script in temporary decoders path
+func loadTestScript(t *testing.T, body string, timeout time.Duration, memoryLimit int64) Decoder {
+	path, err := ioutil.TempDir("", "scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	if err := ioutil.WriteFile(filepath.Join(path, "test_script.js"), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	decoders, err := loadScriptDecoders(path, timeout, memoryLimit)
+	if err != nil || len(decoders) != 1 {
+		t.Fatalf("can't load script: %v", err)
+	}
+	return decoders[0]
+}
+
+func TestScriptDecoderBounds(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		body    string
+		payload string
+		err     string
+	}{
+		{"decoded", "function decodeUplink(input) { return {data: {first: input.bytes[0], port: input.fPort}} }", "2A", ""},
+		{"timeout", "function decodeUplink(input) { while (true) {} }", "2A", "timeout"},
+		{"memory", "function decodeUplink(input) { var a = []; while (true) a.push(new Array(1e5).fill(1)) }", "2A", "memory limit"},
+		{"call stack", "function f(n) { return f(n + 1) + 1 }\nfunction decodeUplink(input) { return {data: f(0)} }", "2A", "stack"},
+		{"input", "function decodeUplink(input) { return {data: {}} }", strings.Repeat("00", scriptMaxInput+1), "over 255 bytes"},
+		{"output", "function decodeUplink(input) { return {data: {s: 'x'.repeat(70000)}} }", "2A", "over 65536 bytes"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			decoder := loadTestScript(t, c.body, 500*time.Millisecond, 32<<20)
+			decoded, err := decoder.DecodeUplink(UplinkInput{DevEui: "00-00-00-00-00-00-00-01", FPort: 1, FRMPayload: c.payload})
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if got, want := normalizeJSON(decoded), normalizeJSON(map[string]interface{}{"first": 42, "port": 1}); !sameValue(got, want) {
+					t.Fatalf("got %v, expected %v", got, want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("expected error with %q, got %v", c.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"path/filepath"
+	"reflect"
+
+	"github.com/go-yaml/yaml"
+)
+
+// field sizes in bytes per spec type
+var specTypeSizes = map[string]int{
+	"u8": 1, "i8": 1, "bool": 1,
+	"u16": 2, "i16": 2,
+	"u24": 3, "i24": 3,
+	"u32": 4, "i32": 4,
+	"float": 4, "f32": 4,
+	"f64": 8,
+}
+
+// PayloadSpec type
+// declarative decoder for fixed layout sensors, lives as *.yaml next to decoder plugins
+type PayloadSpec struct {
+	Type    string       `yaml:"type"`
+	Version string       `yaml:"version"`
+	Layouts []SpecLayout `yaml:"layouts"`
+	Samples []SpecSample `yaml:"samples"` // checked by validate-spec command
+}
+
+// SpecLayout type
+// fields are read either at fixed offsets or as channel tagged records, like TrackNet and Cayenne do
+type SpecLayout struct {
+	FPorts    []uint8        `yaml:"fport"` // any port if empty
+	Channels  bool           `yaml:"channels"`
+	TagSize   int            `yaml:"tag_size"` // bytes of channel tag, 1 by default
+	Fields    []SpecField    `yaml:"fields"`
+	Positions []SpecPosition `yaml:"positions"`
+}
+
+// SpecField type
+type SpecField struct {
+	Name    string   `yaml:"name"`
+	Offset  int      `yaml:"offset"`  // offset layouts
+	Channel uint64   `yaml:"channel"` // channel layouts, tag value
+	Type    string   `yaml:"type"`
+	Endian  string   `yaml:"endian"` // big (default) or little
+	Mask    uint64   `yaml:"mask"`   // applied to raw value, result is shifted down to the lowest mask bit
+	Scale   *float64 `yaml:"scale"`
+	Unit    string   `yaml:"unit"` // informational
+}
+
+// SpecPosition type
+// combines decoded fields into Position
+type SpecPosition struct {
+	Name string `yaml:"name"`
+	Lat  string `yaml:"lat"`
+	Lon  string `yaml:"lon"`
+	Alt  string `yaml:"alt"`
+}
+
+// SpecSample type
+type SpecSample struct {
+	FPort   uint8                  `yaml:"fport"`
+	Payload string                 `yaml:"payload"`
+	Expect  map[string]interface{} `yaml:"expect"`
+	Error   bool                   `yaml:"error"` // payload is expected to fail
+}
+
+// loadSpecDecoders func
+// every *.yaml in path is a spec decoder, spec errors are fatal same as broken plugins
+func loadSpecDecoders(path string) ([]Decoder, error) {
+	files, err := filepath.Glob(path + "/*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("can't list decoders dir %s: %v", path, err)
+	}
+
+	var decoders []Decoder
+	for _, file := range files {
+		spec, err := LoadPayloadSpec(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't load decoder spec: %v", file, err)
+		}
+		decoders = append(decoders, Decoder{
+			Type:         spec.Type,
+			Version:      spec.Version,
+			Source:       file,
+			DecodeUplink: spec.Decode,
+		})
+	}
+	return decoders, nil
+}
+
+// LoadPayloadSpec func
+func LoadPayloadSpec(file string) (*PayloadSpec, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	spec := PayloadSpec{}
+	if err := yaml.Unmarshal(raw, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, spec.check()
+}
+
+// check func
+// catches spec mistakes at load time rather than on the first uplink
+func (s *PayloadSpec) check() error {
+	if s.Type == "" {
+		return fmt.Errorf("type is missing")
+	}
+	if len(s.Layouts) == 0 {
+		return fmt.Errorf("no layouts")
+	}
+	for i := range s.Layouts {
+		layout := &s.Layouts[i]
+		if layout.TagSize == 0 {
+			layout.TagSize = 1
+		}
+		if layout.TagSize > 8 {
+			return fmt.Errorf("layout %d: tag_size %d is over 8 bytes", i, layout.TagSize)
+		}
+		names := make(map[string]bool)
+		for _, field := range layout.Fields {
+			if field.Name == "" {
+				return fmt.Errorf("layout %d: field without name", i)
+			}
+			if _, ok := specTypeSizes[field.Type]; !ok {
+				return fmt.Errorf("layout %d: field %s has unknown type %q", i, field.Name, field.Type)
+			}
+			if field.Endian != "" && field.Endian != "big" && field.Endian != "little" {
+				return fmt.Errorf("layout %d: field %s has unknown endian %q", i, field.Name, field.Endian)
+			}
+			if field.Offset < 0 {
+				return fmt.Errorf("layout %d: field %s has negative offset", i, field.Name)
+			}
+			names[field.Name] = true
+		}
+		for _, position := range layout.Positions {
+			if position.Name == "" || !names[position.Lat] || !names[position.Lon] || (position.Alt != "" && !names[position.Alt]) {
+				return fmt.Errorf("layout %d: position %q refers to unknown fields", i, position.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// layout func
+// first layout listing the port, or the first one without ports
+func (s *PayloadSpec) layout(fport uint8) *SpecLayout {
+	var fallback *SpecLayout
+	for i := range s.Layouts {
+		layout := &s.Layouts[i]
+		if len(layout.FPorts) == 0 && fallback == nil {
+			fallback = layout
+		}
+		for _, port := range layout.FPorts {
+			if port == fport {
+				return layout
+			}
+		}
+	}
+	return fallback
+}
+
+// Decode func
+// gives map[string]interface{} just like Decode of plugins
+func (s *PayloadSpec) Decode(in UplinkInput) (interface{}, error) {
+	data, err := hex.DecodeString(in.FRMPayload)
+	if err != nil {
+		return nil, fmt.Errorf("payload %s is not hex: %v", in.FRMPayload, err)
+	}
+	layout := s.layout(in.FPort)
+	if layout == nil {
+		return nil, &skippedFPortError{in.FPort}
+	}
+
+	decoded := make(map[string]interface{})
+	if layout.Channels {
+		err = layout.decodeChannels(data, decoded)
+	} else {
+		err = layout.decodeOffsets(data, decoded)
+	}
+	if err != nil {
+		return decoded, err
+	}
+
+	for _, position := range layout.Positions {
+		lat, latOk := decoded[position.Lat]
+		lon, lonOk := decoded[position.Lon]
+		if !latOk || !lonOk {
+			continue
+		}
+		p := Position{Lat: toFloat(lat), Lon: toFloat(lon), Source: s.Type}
+		if alt, ok := decoded[position.Alt]; ok {
+			altitude := toFloat(alt)
+			p.Alt = &altitude
+			delete(decoded, position.Alt)
+		}
+		delete(decoded, position.Lat)
+		delete(decoded, position.Lon)
+		decoded[position.Name] = p
+	}
+	return decoded, nil
+}
+
+func (l *SpecLayout) decodeOffsets(data []byte, decoded map[string]interface{}) error {
+	for _, field := range l.Fields {
+		size := specTypeSizes[field.Type]
+		if field.Offset+size > len(data) {
+			return &decodeError{field.Offset, fmt.Sprintf("%s needs %d bytes, %d left", field.Name, size, len(data)-field.Offset)}
+		}
+		decoded[field.Name] = field.value(data[field.Offset : field.Offset+size])
+	}
+	return nil
+}
+
+func (l *SpecLayout) decodeChannels(data []byte, decoded map[string]interface{}) error {
+	for offset := 0; offset < len(data); {
+		if offset+l.TagSize > len(data) {
+			return &decodeError{offset, "truncated channel tag"}
+		}
+		tag := unsignedInt(data[offset : offset+l.TagSize])
+
+		var field *SpecField
+		for i := range l.Fields {
+			if l.Fields[i].Channel == tag {
+				field = &l.Fields[i]
+				break
+			}
+		}
+		if field == nil {
+			return &decodeError{offset, fmt.Sprintf("unknown channel 0x%x", tag)}
+		}
+		offset += l.TagSize
+
+		size := specTypeSizes[field.Type]
+		if offset+size > len(data) {
+			return &decodeError{offset, fmt.Sprintf("%s needs %d bytes, %d left", field.Name, size, len(data)-offset)}
+		}
+		decoded[field.Name] = field.value(data[offset : offset+size])
+		offset += size
+	}
+	return nil
+}
+
+// value func
+// integers stay integers unless scaled, masked values are unsigned
+func (f *SpecField) value(data []byte) interface{} {
+	raw := make([]byte, len(data))
+	copy(raw, data)
+	if f.Endian == "little" {
+		for i, j := 0, len(raw)-1; i < j; i, j = i+1, j-1 {
+			raw[i], raw[j] = raw[j], raw[i]
+		}
+	}
+
+	var value interface{}
+	switch f.Type {
+	case "float", "f32":
+		value = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+	case "f64":
+		value = math.Float64frombits(binary.BigEndian.Uint64(raw))
+	default:
+		u := unsignedInt(raw)
+		switch {
+		case f.Mask != 0:
+			value = int64((u & f.Mask) >> uint(bits.TrailingZeros64(f.Mask)))
+		case f.Type[0] == 'i':
+			value = signedInt(raw)
+		default:
+			value = int64(u)
+		}
+		if f.Type == "bool" {
+			return value.(int64) != 0
+		}
+	}
+
+	if f.Scale != nil {
+		return toFloat(value) * *f.Scale
+	}
+	return value
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+// Validate func
+// runs samples of the spec, returns one line per failed sample
+func (s *PayloadSpec) Validate() []string {
+	var failures []string
+	for i, sample := range s.Samples {
+		decoded, err := s.Decode(UplinkInput{FPort: sample.FPort, FRMPayload: sample.Payload})
+		switch {
+		case sample.Error && err == nil:
+			failures = append(failures, fmt.Sprintf("sample %d (%s): error expected, decoded %v", i, sample.Payload, decoded))
+		case !sample.Error && err != nil:
+			failures = append(failures, fmt.Sprintf("sample %d (%s): %v", i, sample.Payload, err))
+		case !sample.Error:
+			// positions compare in their json form, {lat, lon, alt, source}
+			got, want := normalizeJSON(decoded), normalizeJSON(yamlToJSON(sample.Expect))
+			if !sameValue(got, want) {
+				failures = append(failures, fmt.Sprintf("sample %d (%s): got %v, expected %v", i, sample.Payload, got, want))
+			}
+		}
+	}
+	return failures
+}
+
+// sameValue func
+// deep equality with float tolerance, scaled values are rarely exact
+func sameValue(got interface{}, want interface{}) bool {
+	switch w := want.(type) {
+	case float64:
+		g, ok := got.(float64)
+		return ok && math.Abs(g-w) <= 1e-9*math.Max(1, math.Abs(w))
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for k, v := range w {
+			if !sameValue(g[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !sameValue(g[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+// yamlToJSON func
+// yaml gives map[interface{}]interface{} for nested maps, json can't take those
+func yamlToJSON(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, each := range value {
+			converted[fmt.Sprint(k)] = yamlToJSON(each)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, each := range value {
+			converted[k] = yamlToJSON(each)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, each := range value {
+			converted[i] = yamlToJSON(each)
+		}
+		return converted
+	}
+	return v
+}
+
+// normalizeJSON func
+// json round trip, so yaml and decoded values compare by value regardless of go types
+func normalizeJSON(v interface{}) interface{} {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	var normalized interface{}
+	json.Unmarshal(raw, &normalized)
+	return normalized
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/go-yaml/yaml"
+)
+
+const testSpec = `
+type: test_sensor
+version: "1"
+layouts:
+  - fport: [1]
+    fields:
+      - {name: flags, offset: 0, type: u8, mask: 0xF0}
+      - {name: alarm, offset: 0, type: bool}
+      - {name: temperature, offset: 1, type: i16, scale: 0.1}
+      - {name: counter, offset: 3, type: u16, endian: little}
+      - {name: lat, offset: 5, type: i24, scale: 0.0001}
+      - {name: lon, offset: 8, type: i24, scale: 0.0001}
+      - {name: pressure, offset: 11, type: f32}
+    positions:
+      - {name: location, lat: lat, lon: lon}
+  - fport: [2]
+    channels: true
+    fields:
+      - {channel: 1, name: battery, type: u16, scale: 0.001}
+      - {channel: 2, name: level, type: i8}
+`
+
+func loadTestSpec(t testing.TB) *PayloadSpec {
+	spec := PayloadSpec{}
+	if err := yaml.Unmarshal([]byte(testSpec), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.check(); err != nil {
+		t.Fatal(err)
+	}
+	return &spec
+}
+
+// specDecoder func
+// spec decoding on fixed port in the shape of payload only decoders
+func specDecoder(spec *PayloadSpec, fport uint8) func(string) (interface{}, error) {
+	return func(payload string) (interface{}, error) {
+		return spec.Decode(UplinkInput{FPort: fport, FRMPayload: payload})
+	}
+}
+
+func TestPayloadSpecOffsets(t *testing.T) {
+	spec := loadTestSpec(t)
+	checkDecoderCases(t, specDecoder(spec, 1), []decoderCase{
+		{"all fields", "31FF3801020AE9D1F5162F447A0000", map[string]interface{}{
+			"flags":       3,
+			"alarm":       true,
+			"temperature": -20.0,
+			"counter":     513,
+			"location":    position(71.5217, -71.5217, nil, "test_sensor"),
+			"pressure":    1000.0,
+		}, -1},
+		{"truncated field", "31FF3801020AE9D1F5162F447A00", map[string]interface{}{
+			"flags":       3,
+			"alarm":       true,
+			"temperature": -20.0,
+			"counter":     513,
+			"lat":         71.5217,
+			"lon":         -71.5217,
+		}, 11},
+		{"empty", "", map[string]interface{}{}, 0},
+	})
+}
+
+func TestPayloadSpecChannels(t *testing.T) {
+	spec := loadTestSpec(t)
+	checkDecoderCases(t, specDecoder(spec, 2), []decoderCase{
+		{"all channels", "010BB802FF", map[string]interface{}{"battery": 3.0, "level": -1}, -1},
+		{"empty", "", map[string]interface{}{}, -1},
+		{"unknown channel", "0300", map[string]interface{}{}, 0},
+		{"truncated value", "010B", map[string]interface{}{}, 1},
+		{"truncated value after channel", "02FF01", map[string]interface{}{"level": -1}, 3},
+	})
+}
+
+func TestPayloadSpecSkippedFPort(t *testing.T) {
+	spec := loadTestSpec(t)
+	_, err := spec.Decode(UplinkInput{FPort: 3, FRMPayload: "01"})
+	if skipped, ok := err.(*skippedFPortError); !ok || skipped.FPort != 3 {
+		t.Fatalf("expected FPort 3 skipped, got %v", err)
+	}
+}
+
+func FuzzPayloadSpecDecode(f *testing.F) {
+	spec := loadTestSpec(f)
+	for _, seed := range []struct {
+		fport   uint8
+		payload string
+	}{
+		{1, "31FF3801020AE9D1F5162F447A0000"}, {1, "31FF3801020AE9D1F5162F447A00"}, {1, ""},
+		{2, "010BB802FF"}, {2, "0300"}, {2, "010B"}, {2, "02FF01"}, {3, "01"},
+	} {
+		data, _ := hex.DecodeString(seed.payload)
+		f.Add(seed.fport, data)
+	}
+	f.Fuzz(func(t *testing.T, fport uint8, data []byte) {
+		_, err := spec.Decode(UplinkInput{FPort: fport, FRMPayload: hex.EncodeToString(data)})
+		switch failed := err.(type) {
+		case nil, *skippedFPortError:
+		case *decodeError:
+			if failed.Offset < 0 || failed.Offset > len(data) {
+				t.Fatalf("offset %d out of %d bytes payload", failed.Offset, len(data))
+			}
+		default:
+			t.Fatalf("hex payload failed without offset: %v", err)
+		}
+	})
+}
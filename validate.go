@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// EUI64 as TCIO wants it, see message specs in appxmodel.go
+var eui64 = regexp.MustCompile(`^([0-9A-F]{2}-){7}[0-9A-F]{2}$`)
+
+// maxPayloadSizes per region and data rate, LoRaWAN Regional Parameters N (no FOpts, repeater compatible)
+var maxPayloadSizes = map[string][]int{
+	"EU863": {51, 51, 51, 115, 222, 222, 222, 222},
+	"US902": {11, 53, 125, 222, 222, 0, 0, 0, 33, 109, 222, 222, 222, 222},
+	"AU915": {51, 51, 51, 115, 222, 222, 222, 0, 33, 109, 222, 222, 222, 222},
+	"AS923": {51, 51, 51, 115, 222, 222, 222, 222},
+	"CN470": {51, 51, 51, 115, 222, 222},
+	"KR920": {51, 51, 51, 115, 222, 222},
+	"IN865": {51, 51, 51, 115, 222, 222, 222, 222},
+}
+
+// maxPayloadSize func
+// zero when there is nothing known for the region or data rate
+func maxPayloadSize(region string, dr uint32) int {
+	sizes, ok := maxPayloadSizes[region]
+	if !ok || int(dr) >= len(sizes) {
+		return 0
+	}
+	return sizes[dr]
+}
+
+// rx1DataRates per region, RX1 downlink DR by uplink DR at the default RX1DROffset 0,
+// in other regions RX1 goes at the uplink DR
+var rx1DataRates = map[string][]uint32{
+	"US902": {10, 11, 12, 13, 13},
+	"AU915": {8, 9, 10, 11, 12, 13, 13},
+}
+
+// rx2DataRates per region, default RX2 DR
+var rx2DataRates = map[string]uint32{
+	"EU863": 0,
+	"US902": 8,
+	"AU915": 8,
+	"AS923": 2,
+	"CN470": 0,
+	"KR920": 0,
+	"IN865": 2,
+}
+
+// downlinkPayloadSize func
+// downlink goes at RX1 or RX2 data rate, not at the uplink one, TCIO picks the window,
+// so payload fitting either of them is fine, the larger limit and its DR are returned
+func downlinkPayloadSize(seen deviceRadio) (int, uint32) {
+	rx1 := seen.DR
+	if rates, ok := rx1DataRates[seen.Region]; ok {
+		if int(seen.DR) >= len(rates) {
+			return 0, seen.DR
+		}
+		rx1 = rates[seen.DR]
+	}
+	max, dr := maxPayloadSize(seen.Region, rx1), rx1
+	if rx2, ok := rx2DataRates[seen.Region]; ok {
+		if size := maxPayloadSize(seen.Region, rx2); size > max {
+			max, dr = size, rx2
+		}
+	}
+	return max, dr
+}
+
+var radio = newRadioTable()
+
+// deviceRadio type
+type deviceRadio struct {
+	Region string
+	DR     uint32
+}
+
+// radioTable type
+// region and data rate of the latest uplink per device, downlink data rate follows from them
+type radioTable struct {
+	devices map[string]deviceRadio
+	mu      sync.RWMutex
+}
+
+func newRadioTable() *radioTable {
+	return &radioTable{devices: make(map[string]deviceRadio)}
+}
+
+// Learn func
+func (r *radioTable) Learn(event *TrackNetMessage) {
+	var seen deviceRadio
+	switch {
+	case event.MsgType == "updf" && event.TracknetUpDfMsg != nil:
+		seen = deviceRadio{event.TracknetUpDfMsg.Region, event.TracknetUpDfMsg.DR}
+	case event.MsgType == "joining" && event.TracknetJoiningMsg != nil:
+		seen = deviceRadio{event.TracknetJoiningMsg.Region, event.TracknetJoiningMsg.DR}
+	default:
+		return
+	}
+	if event.DevEui == "" || seen.Region == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices[event.DevEui] = seen
+}
+
+// Lookup func
+func (r *radioTable) Lookup(deveui string) (deviceRadio, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen, ok := r.devices[deveui]
+	return seen, ok
+}
+
+// ValidateDownlink func
+// checks dndf before it goes to ledger and TCIO, MsgId must not be assigned yet if it was not given by submitter
+func ValidateDownlink(msg *TracknetDnDfSpecialMsg) *DownlinkError {
+	if !eui64.MatchString(msg.DevEui) {
+		return &DownlinkError{"invalid_deveui", "DevEui", fmt.Sprintf("DevEui %q is not EUI64 of form HH-HH-HH-HH-HH-HH-HH-HH with uppercase hex digits", msg.DevEui)}
+	}
+	if msg.FPort < 1 || msg.FPort > 223 {
+		return &DownlinkError{"invalid_fport", "FPort", fmt.Sprintf("FPort %v is out of application range 1-223", msg.FPort)}
+	}
+	payload, err := hex.DecodeString(msg.FRMPayload)
+	if err != nil {
+		return &DownlinkError{"invalid_payload", "FRMPayload", fmt.Sprintf("FRMPayload is not hex string: %v", err)}
+	}
+	if msg.MsgID != 0 {
+		if _, seen := ledger.Get(msg.MsgID); seen {
+			return &DownlinkError{"duplicate_msgid", "MsgId", fmt.Sprintf("MsgId %v was already used", msg.MsgID)}
+		}
+	}
+
+	if seen, ok := radio.Lookup(msg.DevEui); ok {
+		if max, dr := downlinkPayloadSize(seen); max > 0 && len(payload) > max {
+			return &DownlinkError{"payload_too_large", "FRMPayload", fmt.Sprintf("payload of %v bytes exceeds %v bytes allowed at downlink DR%v in %s (uplink DR%v)", len(payload), max, dr, seen.Region, seen.DR)}
+		}
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ type connection struct {
 	appxID  string
 	alive   bool
 	msgRx   int64
+	wmu     *sync.Mutex // gorilla allows only one concurrent writer
 }
 
 // connPool type
@@ -117,6 +118,20 @@ func (conn *connection) WriteAppxNode(dnMessage chan<- []byte) {
 
 }
 
+// WriteJSON func
+func (conn *connection) WriteJSON(v interface{}) error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	return conn.ws.WriteJSON(v)
+}
+
+// WriteMessage func
+func (conn *connection) WriteMessage(messageType int, data []byte) error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	return conn.ws.WriteMessage(messageType, data)
+}
+
 func (conn *connection) Respawn(timeout time.Duration, appxMessage chan<- AppxMessage) {
 	var err error
 	logger.Warnf("Trying to reconnect to %s in %v", conn.appxURI, timeout)
@@ -142,6 +157,7 @@ func (conn *connection) Respawn(timeout time.Duration, appxMessage chan<- AppxMe
 				go conn.ListenAppxNode(appxMessage)
 				go conn.keepAlive(time.Duration(*keepAlive)*time.Second, appxMessage)
 				wsConnections.Inc()
+				go conn.ctx.FlushOutbox()
 				return
 			}
 		}
@@ -158,7 +174,7 @@ func (conn *connection) keepAlive(timeout time.Duration, appxMessage chan<- Appx
 
 	go func() {
 		for {
-			err := conn.ws.WriteMessage(websocket.PingMessage, []byte("keepalive"))
+			err := conn.WriteMessage(websocket.PingMessage, []byte("keepalive"))
 			if err != nil {
 				logger.Errorf("Failed to send ping %+v", err)
 			}
@@ -194,7 +210,7 @@ func (p *connPool) CloseAll() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	for conn := range p.connections {
-		conn.ws.WriteMessage(websocket.CloseMessage, []byte{})
+		conn.WriteMessage(websocket.CloseMessage, []byte{})
 		if err := conn.ws.Close(); err != nil {
 			logger.Warningf("CloseAll error closing %s %+v", conn.appxURI, err)
 		}